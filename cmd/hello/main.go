@@ -15,6 +15,12 @@ var (
 	version string
 )
 
+var table = passpersist.MustNewTable([]int{3, 1},
+	[]passpersist.IndexComponent{{Name: "index", Type: passpersist.IndexInt}},
+	passpersist.Column{Number: 1, Name: "first", Type: passpersist.ColumnString},
+	passpersist.Column{Number: 2, Name: "second", Type: passpersist.ColumnString},
+)
+
 func runner(pp *passpersist.PassPersist) {
 	epoch := time.Duration(time.Now().UnixNano())
 	pp.MustAddString([]int{0}, "Hello from PassPersist")
@@ -26,6 +32,14 @@ func runner(pp *passpersist.PassPersist) {
 			pp.MustAddString([]int{i, j}, fmt.Sprintf("Value: %d.%d", i, j))
 		}
 	}
+
+	for i := 1; i <= 2; i++ {
+		pp.MustAddRow(table, map[string]any{
+			"index":  i,
+			"first":  fmt.Sprintf("Row %d first", i),
+			"second": fmt.Sprintf("Row %d second", i),
+		})
+	}
 }
 
 func main() {
@@ -0,0 +1,392 @@
+package passpersist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxMessageSize is the largest SNMP message the agent sends, the
+// largest UDP payload by default
+const DefaultMaxMessageSize = 65507
+
+// AgentOption configures an Agent
+type AgentOption func(*Agent)
+
+// WithCommunity allows SNMPv1 and SNMPv2c requests using community, it may be
+// given more than once. Without any community only SNMPv3 is served.
+func WithCommunity(community string) AgentOption {
+	return func(a *Agent) {
+		a.communities[community] = true
+	}
+}
+
+// WithMaxMessageSize sets the largest response the agent sends
+func WithMaxMessageSize(n int) AgentOption {
+	return func(a *Agent) {
+		a.maxMessageSize = n
+	}
+}
+
+// WithEngineID sets the SNMPv3 engine ID, a random ID is generated by
+// default. It should be stable across restarts.
+func WithEngineID(id []byte) AgentOption {
+	return func(a *Agent) {
+		a.engineID = id
+	}
+}
+
+// WithEngineBoots sets the SNMPv3 engine boots, which should be incremented
+// each time the agent starts with the same engine ID. Defaults to 1.
+func WithEngineBoots(boots int32) AgentOption {
+	return func(a *Agent) {
+		a.engineBoots = boots
+	}
+}
+
+// WithUSMUser adds an SNMPv3 user. Requests of the user must be
+// authenticated, and encrypted when priv is not PrivNone. Passwords must be
+// at least 8 characters long.
+func WithUSMUser(name string, auth AuthProtocol, authPassword string, priv PrivProtocol, privPassword string) AgentOption {
+	return func(a *Agent) {
+		a.userSpecs = append(a.userSpecs, userSpec{name, auth, authPassword, priv, privPassword})
+	}
+}
+
+type userSpec struct {
+	name         string
+	auth         AuthProtocol
+	authPassword string
+	priv         PrivProtocol
+	privPassword string
+}
+
+// Agent answers SNMP GET, GETNEXT and GETBULK requests from a Cache, for
+// hosts where snmpd is not available. Sets are answered with notWritable.
+type Agent struct {
+	cache          *Cache
+	communities    map[string]bool
+	maxMessageSize int
+
+	engineID    []byte
+	engineBoots int32
+	startTime   time.Time
+	userSpecs   []userSpec
+	users       map[string]*usmUser
+	salt        atomic.Uint64
+	usmStats    [usmStatsDecryptionErrors + 1]atomic.Uint32
+}
+
+// NewAgent returns an agent serving c, it fails on an invalid SNMPv3 user
+func NewAgent(c *Cache, opts ...AgentOption) (*Agent, error) {
+	a := &Agent{
+		cache:          c,
+		communities:    make(map[string]bool),
+		maxMessageSize: DefaultMaxMessageSize,
+		engineBoots:    1,
+		users:          make(map[string]*usmUser),
+	}
+
+	for _, fn := range opts {
+		fn(a)
+	}
+
+	if a.engineID == nil {
+		a.engineID = newEngineID()
+	}
+
+	for _, s := range a.userSpecs {
+		u, err := newUSMUser(s.name, s.auth, s.authPassword, s.priv, s.privPassword, a.engineID)
+		if err != nil {
+			return nil, err
+		}
+		a.users[u.name] = u
+	}
+
+	var salt [8]byte
+	rand.Read(salt[:])
+	a.salt.Store(binary.BigEndian.Uint64(salt[:]))
+	a.startTime = time.Now()
+
+	return a, nil
+}
+
+// newEngineID returns a random engine ID in the RFC 3411 octets format
+// under the net-snmp enterprise number
+func newEngineID() []byte {
+	id := []byte{0x80, 0x00, 0x1f, 0x88, 0x05, 0, 0, 0, 0, 0, 0, 0, 0}
+	rand.Read(id[5:])
+	return id
+}
+
+// ListenAndServe listens on the UDP address addr, e.g. ":161", and serves
+// requests until ctx is done
+func (a *Agent) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	return a.Serve(ctx, conn)
+}
+
+// Serve answers requests received on conn until ctx is done. conn is closed
+// when Serve returns.
+func (a *Agent) Serve(ctx context.Context, conn net.PacketConn) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		resp := a.handle(buf[:n])
+		if resp == nil {
+			continue
+		}
+
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			slog.Warn("failed to send response", "addr", addr.String(), slog.Any("error", err))
+		}
+	}
+}
+
+// handle returns the encoded response to the request b or nil when the
+// request is dropped
+func (a *Agent) handle(b []byte) []byte {
+	version, err := peekVersion(b)
+	if err != nil {
+		slog.Debug("dropping invalid message", slog.Any("error", err))
+		return nil
+	}
+
+	switch version {
+	case snmpV1, snmpV2c:
+		return a.handleCommunity(b)
+	case snmpV3:
+		return a.handleV3(b)
+	}
+
+	slog.Debug("dropping message with unsupported version", "version", version)
+	return nil
+}
+
+func (a *Agent) handleCommunity(b []byte) []byte {
+	msg, err := unmarshalMessage(b)
+	if err != nil {
+		slog.Debug("dropping invalid message", slog.Any("error", err))
+		return nil
+	}
+
+	if !a.communities[msg.community] {
+		slog.Debug("dropping message with unknown community", "version", msg.version)
+		return nil
+	}
+
+	resp := a.respond(msg.version, msg.pdu, a.maxMessageSize)
+	if resp == nil {
+		return nil
+	}
+
+	return fitResponse(msg.pdu, resp, a.maxMessageSize, func(p *snmpPDU) []byte {
+		return (&snmpMessage{version: msg.version, community: msg.community, pdu: p}).marshal()
+	})
+}
+
+// respond returns the response to req or nil when it should be dropped,
+// GetBulk responses are limited to about maxSize octets
+func (a *Agent) respond(version int, req *snmpPDU, maxSize int) *snmpPDU {
+	resp := &snmpPDU{tag: pduResponse, requestID: req.requestID}
+	// all variables are answered from the same generation
+	snap := a.cache.Snapshot()
+
+	switch req.tag {
+	case pduGetRequest:
+		for i, vb := range req.varBinds {
+			v := snap.Get(vb.oid)
+			if v == nil || (version == snmpV1 && berTagOf(&v.Value) == tagCounter64) {
+				if version == snmpV1 {
+					return v1Error(req, errNoSuchName, i)
+				}
+				resp.varBinds = append(resp.varBinds, snmpVarBind{oid: vb.oid, tag: missingTag(snap, vb.oid)})
+				continue
+			}
+			resp.varBinds = append(resp.varBinds, newSNMPVarBind(v))
+		}
+	case pduGetNextRequest:
+		for i, vb := range req.varBinds {
+			next, ok := nextVarBind(snap, version, vb.oid)
+			if !ok && version == snmpV1 {
+				return v1Error(req, errNoSuchName, i)
+			}
+			resp.varBinds = append(resp.varBinds, next)
+		}
+	case pduGetBulkRequest:
+		if version == snmpV1 {
+			return nil
+		}
+		resp.varBinds = bulk(snap, req, maxSize)
+	case pduSetRequest:
+		if version == snmpV1 {
+			return v1Error(req, errNoSuchName, 0)
+		}
+		resp.varBinds = req.varBinds
+		resp.errorStatus = errNotWritable
+		resp.errorIndex = 1
+	default:
+		slog.Debug("dropping unsupported pdu", "type", req.tag)
+		return nil
+	}
+
+	return resp
+}
+
+// nextVarBind returns the entry following oid or endOfMibView. SNMPv1 cannot carry
+// Counter64 values so they are skipped.
+func nextVarBind(snap *Snapshot, version int, oid OID) (snmpVarBind, bool) {
+	for {
+		v := snap.GetNext(oid)
+		if v == nil {
+			return snmpVarBind{oid: oid, tag: tagEndOfMibView}, false
+		}
+		if version == snmpV1 && berTagOf(&v.Value) == tagCounter64 {
+			oid = v.OID
+			continue
+		}
+		return newSNMPVarBind(v), true
+	}
+}
+
+// bulk answers a GetBulk request per RFC 3416 section 4.2.3. Repetitions
+// stop once the encoded variables exceed maxSize, fitResponse would drop
+// them anyway.
+func bulk(snap *Snapshot, req *snmpPDU, maxSize int) []snmpVarBind {
+	nonRepeaters := req.errorStatus
+	maxRepetitions := req.errorIndex
+
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(req.varBinds) {
+		nonRepeaters = len(req.varBinds)
+	}
+	if maxRepetitions < 0 {
+		maxRepetitions = 0
+	}
+
+	size := 0
+	var vbs []snmpVarBind
+	for _, vb := range req.varBinds[:nonRepeaters] {
+		next, _ := nextVarBind(snap, snmpV2c, vb.oid)
+		vbs = append(vbs, next)
+		size += len(next.marshal())
+	}
+
+	repeaters := make([]OID, len(req.varBinds)-nonRepeaters)
+	for i, vb := range req.varBinds[nonRepeaters:] {
+		repeaters[i] = vb.oid
+	}
+	maxRepetitions = capRepetitions(maxRepetitions, len(repeaters), maxSize)
+
+	for r := 0; r < maxRepetitions && len(repeaters) > 0; r++ {
+		more := false
+		for i, oid := range repeaters {
+			next, ok := nextVarBind(snap, snmpV2c, oid)
+			vbs = append(vbs, next)
+			if size += len(next.marshal()); size > maxSize {
+				return vbs
+			}
+			repeaters[i] = next.oid
+			more = more || ok
+		}
+		if !more {
+			break
+		}
+	}
+
+	return vbs
+}
+
+// capRepetitions bounds the max-repetitions of a GetBulk request to what
+// could fit in maxSize octets, each variable taking more than one
+func capRepetitions(maxRepetitions int, repeaters int, maxSize int) int {
+	if repeaters > 0 && maxRepetitions > maxSize/repeaters {
+		return maxSize / repeaters
+	}
+	return maxRepetitions
+}
+
+// missingTag returns noSuchInstance when the object of oid exists but not
+// the instance, noSuchObject otherwise
+func missingTag(snap *Snapshot, oid OID) byte {
+	if len(oid.Value) < 3 {
+		return tagNoSuchObject
+	}
+
+	parent := OID{oid.Value[:len(oid.Value)-1]}
+	if v := snap.GetNext(parent); v != nil && v.OID.StartsWith(parent) {
+		return tagNoSuchInstance
+	}
+	return tagNoSuchObject
+}
+
+// v1Error returns an SNMPv1 error response echoing the request variables
+func v1Error(req *snmpPDU, status int, index int) *snmpPDU {
+	return &snmpPDU{
+		tag:         pduResponse,
+		requestID:   req.requestID,
+		errorStatus: status,
+		errorIndex:  index + 1,
+		varBinds:    req.varBinds,
+	}
+}
+
+// fitResponse encodes resp, dropping trailing GetBulk variables or answering
+// tooBig when the message is larger than maxSize
+func fitResponse(req *snmpPDU, resp *snmpPDU, maxSize int, encode func(*snmpPDU) []byte) []byte {
+	b := encode(resp)
+
+	if req.tag == pduGetBulkRequest {
+		for len(b) > maxSize && len(resp.varBinds) > 1 {
+			n := len(resp.varBinds) * maxSize / len(b)
+			if n >= len(resp.varBinds) {
+				n = len(resp.varBinds) - 1
+			}
+			if n < 1 {
+				n = 1
+			}
+			resp.varBinds = resp.varBinds[:n]
+			b = encode(resp)
+		}
+	}
+
+	if len(b) > maxSize {
+		slog.Debug("response too big", "size", len(b), "max", maxSize)
+		return encode(&snmpPDU{
+			tag:         pduResponse,
+			requestID:   req.requestID,
+			errorStatus: errTooBig,
+		})
+	}
+
+	return b
+}
@@ -0,0 +1,308 @@
+package passpersist
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestCache() *Cache {
+	c := NewCache()
+	base := MustNewOID("1.3.6.1.4.1.8072")
+	values := map[int]typedValue{
+		1: {&StringVal{"hello"}},
+		2: {&IntVal{-42}},
+		3: {&Counter64Val{1 << 40}},
+		4: {&IPAddrVal{netip.MustParseAddr("192.0.2.1")}},
+		5: {&TimeTicksVal{12 * time.Second}},
+	}
+	for i, v := range values {
+		c.Set(&VarBind{OID: base.MustAppend([]int{i, 0}), ValueType: v.TypeString(), Value: v})
+	}
+	c.Commit()
+	return c
+}
+
+func newTestAgent(t *testing.T, c *Cache, opts ...AgentOption) *Agent {
+	t.Helper()
+
+	a, err := NewAgent(c, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func startTestAgent(t *testing.T, a *Agent) net.Addr {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go a.Serve(ctx, conn)
+
+	return conn.LocalAddr()
+}
+
+// exchange sends b to addr and returns the response or nil after a timeout
+func exchange(t *testing.T, addr net.Addr, b []byte) []byte {
+	t.Helper()
+
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func request(t *testing.T, addr net.Addr, version int, community string, pdu *snmpPDU) *snmpPDU {
+	t.Helper()
+
+	b := exchange(t, addr, (&snmpMessage{version: version, community: community, pdu: pdu}).marshal())
+	if b == nil {
+		return nil
+	}
+
+	msg, err := unmarshalMessage(b)
+	if err != nil {
+		t.Fatalf("invalid response: %s", err)
+	}
+	if msg.pdu.requestID != pdu.requestID {
+		t.Errorf("expected request id %d, got %d", pdu.requestID, msg.pdu.requestID)
+	}
+	return msg.pdu
+}
+
+func nullVarBinds(oids ...string) []snmpVarBind {
+	vbs := make([]snmpVarBind, len(oids))
+	for i, o := range oids {
+		vbs[i] = snmpVarBind{oid: MustNewOID(o), tag: tagNull}
+	}
+	return vbs
+}
+
+func TestAgentGet(t *testing.T) {
+	addr := startTestAgent(t, newTestAgent(t, newTestCache(), WithCommunity("public")))
+
+	resp := request(t, addr, snmpV2c, "public", &snmpPDU{
+		tag:       pduGetRequest,
+		requestID: 1,
+		varBinds: nullVarBinds(
+			"1.3.6.1.4.1.8072.1.0",
+			"1.3.6.1.4.1.8072.3.0",
+			"1.3.6.1.4.1.8072.5.0",
+			"1.3.6.1.4.1.8072.1.1",
+			"1.3.6.1.4.1.8072.9.0",
+		),
+	})
+	if resp == nil {
+		t.Fatal("no response")
+	}
+
+	vbs := resp.varBinds
+	if len(vbs) != 5 {
+		t.Fatalf("expected 5 variables, got %d", len(vbs))
+	}
+	if string(vbs[0].value.GetOctetStringVal()) != "hello" {
+		t.Errorf("unexpected value %v", vbs[0].value.String())
+	}
+	if vbs[1].value.GetCouter64Val() != 1<<40 {
+		t.Errorf("unexpected value %v", vbs[1].value.String())
+	}
+	if vbs[2].value.GetTimeTicksVal() != 12*time.Second {
+		t.Errorf("unexpected value %v", vbs[2].value.String())
+	}
+	if vbs[3].tag != tagNoSuchInstance {
+		t.Errorf("expected noSuchInstance, got 0x%02x", vbs[3].tag)
+	}
+	if vbs[4].tag != tagNoSuchObject {
+		t.Errorf("expected noSuchObject, got 0x%02x", vbs[4].tag)
+	}
+}
+
+func TestAgentGetNext(t *testing.T) {
+	addr := startTestAgent(t, newTestAgent(t, newTestCache(), WithCommunity("public")))
+
+	resp := request(t, addr, snmpV2c, "public", &snmpPDU{
+		tag:       pduGetNextRequest,
+		requestID: 2,
+		varBinds:  nullVarBinds("1.3.6.1.4.1.8072", "1.3.6.1.4.1.8072.5.0"),
+	})
+	if resp == nil {
+		t.Fatal("no response")
+	}
+
+	if got := resp.varBinds[0].oid.String(); got != "1.3.6.1.4.1.8072.1.0" {
+		t.Errorf("unexpected next oid %s", got)
+	}
+	if resp.varBinds[1].tag != tagEndOfMibView {
+		t.Errorf("expected endOfMibView, got 0x%02x", resp.varBinds[1].tag)
+	}
+
+	// SNMPv1 skips Counter64 and reports the end of the view as noSuchName
+	resp = request(t, addr, snmpV1, "public", &snmpPDU{
+		tag:       pduGetNextRequest,
+		requestID: 3,
+		varBinds:  nullVarBinds("1.3.6.1.4.1.8072.2.0"),
+	})
+	if got := resp.varBinds[0].oid.String(); got != "1.3.6.1.4.1.8072.4.0" {
+		t.Errorf("expected Counter64 to be skipped, got %s", got)
+	}
+
+	resp = request(t, addr, snmpV1, "public", &snmpPDU{
+		tag:       pduGetNextRequest,
+		requestID: 4,
+		varBinds:  nullVarBinds("1.3.6.1.4.1.8072.5.0"),
+	})
+	if resp.errorStatus != errNoSuchName || resp.errorIndex != 1 {
+		t.Errorf("expected noSuchName, got %d/%d", resp.errorStatus, resp.errorIndex)
+	}
+}
+
+func TestAgentGetBulk(t *testing.T) {
+	addr := startTestAgent(t, newTestAgent(t, newTestCache(), WithCommunity("public")))
+
+	resp := request(t, addr, snmpV2c, "public", &snmpPDU{
+		tag:         pduGetBulkRequest,
+		requestID:   5,
+		errorStatus: 1,
+		errorIndex:  10,
+		varBinds:    nullVarBinds("1.3.6.1.4.1.8072", "1.3.6.1.4.1.8072.2"),
+	})
+	if resp == nil {
+		t.Fatal("no response")
+	}
+
+	want := []string{
+		"1.3.6.1.4.1.8072.1.0",
+		"1.3.6.1.4.1.8072.2.0",
+		"1.3.6.1.4.1.8072.3.0",
+		"1.3.6.1.4.1.8072.4.0",
+		"1.3.6.1.4.1.8072.5.0",
+		"1.3.6.1.4.1.8072.5.0",
+	}
+	if len(resp.varBinds) != len(want) {
+		t.Fatalf("expected %d variables, got %d", len(want), len(resp.varBinds))
+	}
+	for i, o := range want {
+		if got := resp.varBinds[i].oid.String(); got != o {
+			t.Errorf("%d: expected %s, got %s", i, o, got)
+		}
+	}
+	if resp.varBinds[5].tag != tagEndOfMibView {
+		t.Errorf("expected endOfMibView")
+	}
+}
+
+func TestAgentMaxMessageSize(t *testing.T) {
+	addr := startTestAgent(t, newTestAgent(t, newTestCache(), WithCommunity("public"), WithMaxMessageSize(100)))
+
+	resp := request(t, addr, snmpV2c, "public", &snmpPDU{
+		tag:        pduGetBulkRequest,
+		requestID:  6,
+		errorIndex: 10,
+		varBinds:   nullVarBinds("1.3.6.1.4.1.8072"),
+	})
+	if resp == nil {
+		t.Fatal("no response")
+	}
+	if len(resp.varBinds) == 0 || len(resp.varBinds) >= 5 {
+		t.Errorf("expected bulk response to be truncated, got %d variables", len(resp.varBinds))
+	}
+}
+
+func TestAgentSet(t *testing.T) {
+	addr := startTestAgent(t, newTestAgent(t, newTestCache(), WithCommunity("public")))
+
+	resp := request(t, addr, snmpV2c, "public", &snmpPDU{
+		tag:       pduSetRequest,
+		requestID: 2,
+		varBinds:  nullVarBinds("1.3.6.1.4.1.8072.1.0"),
+	})
+	if resp == nil {
+		t.Fatal("no response")
+	}
+	if resp.errorStatus != errNotWritable || resp.errorIndex != 1 {
+		t.Errorf("expected notWritable at 1, got %d at %d", resp.errorStatus, resp.errorIndex)
+	}
+}
+
+func TestAgentCommunity(t *testing.T) {
+	addr := startTestAgent(t, newTestAgent(t, newTestCache(), WithCommunity("public")))
+
+	resp := request(t, addr, snmpV2c, "private", &snmpPDU{
+		tag:       pduGetRequest,
+		requestID: 7,
+		varBinds:  nullVarBinds("1.3.6.1.4.1.8072.1.0"),
+	})
+	if resp != nil {
+		t.Errorf("expected request with wrong community to be dropped")
+	}
+
+	addr = startTestAgent(t, newTestAgent(t, newTestCache()))
+	resp = request(t, addr, snmpV2c, "public", &snmpPDU{
+		tag:       pduGetRequest,
+		requestID: 8,
+		varBinds:  nullVarBinds("1.3.6.1.4.1.8072.1.0"),
+	})
+	if resp != nil {
+		t.Errorf("expected community requests to be dropped without communities")
+	}
+}
+
+func TestNewAgentInvalidUser(t *testing.T) {
+	for _, opt := range []AgentOption{
+		WithUSMUser("user", AuthProtocol(0), "authpassword", PrivNone, ""),
+		WithUSMUser("user", AuthSHA, "short", PrivNone, ""),
+		WithUSMUser("user", AuthSHA, "authpassword", PrivProtocol(42), "privpassword"),
+		WithUSMUser("user", AuthSHA, "authpassword", PrivAES, "short"),
+	} {
+		if _, err := NewAgent(newTestCache(), opt); err == nil {
+			t.Errorf("expected invalid user to be rejected")
+		}
+	}
+}
+
+func TestBulkMaxRepetitions(t *testing.T) {
+	c := NewCache()
+	base := MustNewOID("1.3.6.1.4.1.8072")
+	for i := 1; i <= 1000; i++ {
+		c.Set(&VarBind{OID: base.MustAppend([]int{i, 0}), ValueType: "INTEGER", Value: typedValue{&IntVal{int32(i)}}})
+	}
+	c.Commit()
+
+	req := &snmpPDU{
+		tag:        pduGetBulkRequest,
+		errorIndex: 1<<31 - 1,
+		varBinds:   nullVarBinds("1.3.6.1.4.1.8072", "1.3.6.1.4.1.8072", "1.3.6.1.4.1.8072"),
+	}
+	vbs := bulk(c.Snapshot(), req, 1500)
+	if len(vbs) == 0 || len(vbs) > 1500/10 {
+		t.Errorf("expected the repetitions to be bounded by the size, got %d variables", len(vbs))
+	}
+
+	ranges := []agentxRange{{start: base}, {start: base}, {start: base}}
+	vbs = agentxBulk(c.Snapshot(), 0, 1<<16-1, ranges, 1500)
+	if len(vbs) == 0 || len(vbs) > 1500/10 {
+		t.Errorf("expected the AgentX repetitions to be bounded by the size, got %d variables", len(vbs))
+	}
+}
@@ -0,0 +1,793 @@
+package passpersist
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AgentX PDU types, RFC 2741 section 6.1
+const (
+	agentxOpen       byte = 1
+	agentxClose      byte = 2
+	agentxRegister   byte = 3
+	agentxGet        byte = 5
+	agentxGetNext    byte = 6
+	agentxGetBulk    byte = 7
+	agentxTestSet    byte = 8
+	agentxCommitSet  byte = 9
+	agentxUndoSet    byte = 10
+	agentxCleanupSet byte = 11
+	agentxPing       byte = 13
+	agentxResponse   byte = 18
+)
+
+// AgentX header flags
+const (
+	agentxFlagNonDefaultContext byte = 0x08
+	agentxFlagNetworkByteOrder  byte = 0x10
+)
+
+// AgentX close reasons
+const (
+	agentxReasonShutdown byte = 5
+)
+
+// AgentX response errors, the SNMP error status values are used for sets
+const (
+	agentxErrParseError      = 266
+	agentxErrProcessingError = 268
+)
+
+const (
+	agentxHeaderLen     = 20
+	agentxMaxPayload    = 1 << 20
+	agentxPriority      = 127
+	agentxTimeout       = 5 * time.Second
+	agentxRetryInterval = 5 * time.Second
+)
+
+// agentxInternetPrefix is omitted from object identifiers in the compressed
+// form
+var agentxInternetPrefix = MustNewOID("1.3.6.1")
+
+var errAgentXTruncated = errors.New("agentx: truncated data")
+
+// WithAgentX makes Run serve the base OID as an AgentX subagent of the
+// master agent at address, e.g. ("unix", "/var/agentx/master") or ("tcp",
+// "localhost:705"), instead of speaking pass_persist on the input. The
+// session is reestablished when the master goes away.
+func WithAgentX(network, address string) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.agentxNetwork = network
+		p.agentxAddress = address
+	}
+}
+
+type agentxPacket struct {
+	pduType       byte
+	flags         byte
+	sessionID     uint32
+	transactionID uint32
+	packetID      uint32
+	payload       []byte
+}
+
+func (pk *agentxPacket) byteOrder() binary.ByteOrder {
+	if pk.flags&agentxFlagNetworkByteOrder != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// marshal encodes the packet, the payload must use the byte order of the
+// flags
+func (pk *agentxPacket) marshal() []byte {
+	order := pk.byteOrder()
+
+	b := make([]byte, agentxHeaderLen, agentxHeaderLen+len(pk.payload))
+	b[0] = 1
+	b[1] = pk.pduType
+	b[2] = pk.flags
+	order.PutUint32(b[4:], pk.sessionID)
+	order.PutUint32(b[8:], pk.transactionID)
+	order.PutUint32(b[12:], pk.packetID)
+	order.PutUint32(b[16:], uint32(len(pk.payload)))
+
+	return append(b, pk.payload...)
+}
+
+func readAgentXPacket(r io.Reader) (*agentxPacket, error) {
+	var h [agentxHeaderLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if h[0] != 1 {
+		return nil, fmt.Errorf("agentx: unsupported version %d", h[0])
+	}
+
+	pk := &agentxPacket{pduType: h[1], flags: h[2]}
+	order := pk.byteOrder()
+	pk.sessionID = order.Uint32(h[4:])
+	pk.transactionID = order.Uint32(h[8:])
+	pk.packetID = order.Uint32(h[12:])
+
+	n := order.Uint32(h[16:])
+	if n > agentxMaxPayload || n%4 != 0 {
+		return nil, fmt.Errorf("agentx: invalid payload length %d", n)
+	}
+
+	pk.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, pk.payload); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+// agentxEncoder appends AgentX data types to a payload
+type agentxEncoder struct {
+	b     []byte
+	order binary.AppendByteOrder
+}
+
+func (e *agentxEncoder) bytes(v ...byte) {
+	e.b = append(e.b, v...)
+}
+
+func (e *agentxEncoder) uint16(v uint16) {
+	e.b = e.order.AppendUint16(e.b, v)
+}
+
+func (e *agentxEncoder) uint32(v uint32) {
+	e.b = e.order.AppendUint32(e.b, v)
+}
+
+func (e *agentxEncoder) uint64(v uint64) {
+	e.b = e.order.AppendUint64(e.b, v)
+}
+
+// oid encodes o, in the compressed form when it starts with 1.3.6.1
+func (e *agentxEncoder) oid(o OID, include bool) {
+	subs := o.Value
+	prefix := 0
+	if len(subs) > 4 && o.StartsWith(agentxInternetPrefix) && subs[4] > 0 && subs[4] < 256 {
+		prefix = subs[4]
+		subs = subs[5:]
+	}
+
+	var inc byte
+	if include {
+		inc = 1
+	}
+
+	e.bytes(byte(len(subs)), byte(prefix), inc, 0)
+	for _, s := range subs {
+		e.uint32(uint32(s))
+	}
+}
+
+// octets encodes v padded to a multiple of 4 octets
+func (e *agentxEncoder) octets(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.b = append(e.b, v...)
+	for len(e.b)%4 != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+// varBind encodes vb, AgentX value types share the numbers of the BER tags
+func (e *agentxEncoder) varBind(vb snmpVarBind) {
+	e.uint16(uint16(vb.tag))
+	e.uint16(0)
+	e.oid(vb.oid, false)
+
+	switch x := vb.value.GetValue().(type) {
+	case *StringVal:
+		e.octets([]byte(x.Value))
+	case *OctetStringVal:
+		e.octets(x.Value)
+	case *IPV6AddrVal:
+		a := x.Value.As16()
+		e.octets(a[:])
+	case *IntVal:
+		e.uint32(uint32(x.Value))
+	case *Counter32Val:
+		e.uint32(x.Value)
+	case *GaugeVal:
+		e.uint32(x.Value)
+	case *TimeTicksVal:
+		e.uint32(uint32(x.Value / (10 * time.Millisecond)))
+	case *Counter64Val:
+		e.uint64(x.Value)
+	case *IPAddrVal:
+		a := x.Value.As4()
+		e.octets(a[:])
+	case *OIDVal:
+		e.oid(x.Value, false)
+	}
+}
+
+// agentxDecoder reads AgentX data types from a payload
+type agentxDecoder struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+func (d *agentxDecoder) empty() bool {
+	return len(d.b) == 0
+}
+
+func (d *agentxDecoder) bytes(n int) ([]byte, error) {
+	if n < 0 || len(d.b) < n {
+		return nil, errAgentXTruncated
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b, nil
+}
+
+func (d *agentxDecoder) uint16() (uint16, error) {
+	b, err := d.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint16(b), nil
+}
+
+func (d *agentxDecoder) uint32() (uint32, error) {
+	b, err := d.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *agentxDecoder) uint64() (uint64, error) {
+	b, err := d.bytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint64(b), nil
+}
+
+// oid decodes an object identifier and its include flag
+func (d *agentxDecoder) oid() (OID, bool, error) {
+	h, err := d.bytes(4)
+	if err != nil {
+		return OID{}, false, err
+	}
+
+	var subs []int
+	if h[1] != 0 {
+		subs = append(subs, 1, 3, 6, 1, int(h[1]))
+	}
+	for i := 0; i < int(h[0]); i++ {
+		s, err := d.uint32()
+		if err != nil {
+			return OID{}, false, err
+		}
+		subs = append(subs, int(s))
+	}
+
+	return OID{subs}, h[2] != 0, nil
+}
+
+func (d *agentxDecoder) octets() ([]byte, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > len(d.b) {
+		return nil, errAgentXTruncated
+	}
+
+	b, err := d.bytes(int(n+3) &^ 3)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+func (d *agentxDecoder) varBind() (snmpVarBind, error) {
+	t, err := d.uint16()
+	if err != nil {
+		return snmpVarBind{}, err
+	}
+	if _, err := d.uint16(); err != nil {
+		return snmpVarBind{}, err
+	}
+
+	oid, _, err := d.oid()
+	if err != nil {
+		return snmpVarBind{}, err
+	}
+
+	vb := snmpVarBind{oid: oid, tag: byte(t)}
+	if t > 0xff {
+		return vb, fmt.Errorf("agentx: unsupported value type %d", t)
+	}
+
+	switch vb.tag {
+	case tagNull, tagNoSuchObject, tagNoSuchInstance, tagEndOfMibView:
+	case tagInteger:
+		v, err := d.uint32()
+		if err != nil {
+			return vb, err
+		}
+		vb.value = typedValue{&IntVal{int32(v)}}
+	case tagCounter32, tagGauge32, tagTimeTicks:
+		v, err := d.uint32()
+		if err != nil {
+			return vb, err
+		}
+		switch vb.tag {
+		case tagCounter32:
+			vb.value = typedValue{&Counter32Val{v}}
+		case tagGauge32:
+			vb.value = typedValue{&GaugeVal{v}}
+		default:
+			vb.value = typedValue{&TimeTicksVal{time.Duration(v) * 10 * time.Millisecond}}
+		}
+	case tagCounter64:
+		v, err := d.uint64()
+		if err != nil {
+			return vb, err
+		}
+		vb.value = typedValue{&Counter64Val{v}}
+	case tagOctetString, tagOpaque:
+		b, err := d.octets()
+		if err != nil {
+			return vb, err
+		}
+		vb.value = typedValue{&OctetStringVal{append([]byte(nil), b...)}}
+	case tagIPAddress:
+		b, err := d.octets()
+		if err != nil {
+			return vb, err
+		}
+		if len(b) != 4 {
+			return vb, fmt.Errorf("agentx: invalid ip address length %d", len(b))
+		}
+		vb.value = typedValue{&IPAddrVal{netip.AddrFrom4([4]byte(b))}}
+	case tagOID:
+		o, _, err := d.oid()
+		if err != nil {
+			return vb, err
+		}
+		vb.value = typedValue{&OIDVal{o}}
+	default:
+		return vb, fmt.Errorf("agentx: unsupported value type %d", t)
+	}
+
+	return vb, nil
+}
+
+// agentxRange is a search range of Get, GetNext and GetBulk requests, a null
+// end is unbounded
+type agentxRange struct {
+	start   OID
+	include bool
+	end     OID
+}
+
+func (d *agentxDecoder) searchRanges() ([]agentxRange, error) {
+	var ranges []agentxRange
+	for !d.empty() {
+		start, include, err := d.oid()
+		if err != nil {
+			return nil, err
+		}
+		end, _, err := d.oid()
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, agentxRange{start, include, end})
+	}
+	return ranges, nil
+}
+
+// agentxSession is a session with an AgentX master agent
+type agentxSession struct {
+	p        *PassPersist
+	conn     net.Conn
+	id       uint32
+	packetID atomic.Uint32
+	writeMu  sync.Mutex
+
+	// values of the set in progress, validated by TestSet
+	pending   []*pendingSet
+	committed bool
+}
+
+type pendingSet struct {
+	h  *setHandler
+	vb *VarBind
+}
+
+// serveAgentX answers the requests of the AgentX master until ctx is done,
+// reconnecting when the session ends
+func (p *PassPersist) serveAgentX(ctx context.Context) {
+	for {
+		err := p.runAgentXSession(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("agentx session ended", "address", p.agentxAddress, slog.Any("error", err))
+
+		select {
+		case <-time.After(agentxRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PassPersist) runAgentXSession(ctx context.Context) error {
+	d := net.Dialer{Timeout: agentxTimeout}
+	conn, err := d.DialContext(ctx, p.agentxNetwork, p.agentxAddress)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s := &agentxSession{p: p, conn: conn}
+
+	conn.SetDeadline(time.Now().Add(agentxTimeout))
+	if err := s.open(); err != nil {
+		return err
+	}
+	if err := s.register(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	slog.Info("registered with agentx master", "address", p.agentxAddress, "oid", p.baseOID.String(), "session", s.id)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.close(agentxReasonShutdown)
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	return s.serve(ctx)
+}
+
+func (s *agentxSession) encoder() *agentxEncoder {
+	return &agentxEncoder{order: binary.BigEndian}
+}
+
+func (s *agentxSession) send(pk *agentxPacket) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	_, err := s.conn.Write(pk.marshal())
+	return err
+}
+
+// request sends a PDU to the master and waits for its response
+func (s *agentxSession) request(pduType byte, payload []byte) (*agentxPacket, error) {
+	req := &agentxPacket{
+		pduType:   pduType,
+		flags:     agentxFlagNetworkByteOrder,
+		sessionID: s.id,
+		packetID:  s.packetID.Add(1),
+		payload:   payload,
+	}
+	if err := s.send(req); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := readAgentXPacket(s.conn)
+		if err != nil {
+			return nil, err
+		}
+		if resp.pduType != agentxResponse || resp.packetID != req.packetID {
+			continue
+		}
+
+		d := &agentxDecoder{b: resp.payload, order: resp.byteOrder()}
+		if _, err := d.uint32(); err != nil {
+			return nil, err
+		}
+		code, err := d.uint16()
+		if err != nil {
+			return nil, err
+		}
+		if code != 0 {
+			return nil, fmt.Errorf("agentx: pdu type %d failed with error %d", pduType, code)
+		}
+		return resp, nil
+	}
+}
+
+func (s *agentxSession) open() error {
+	e := s.encoder()
+	// the master's default timeout
+	e.bytes(0, 0, 0, 0)
+	e.oid(OID{}, false)
+	e.octets([]byte("go-passpersist"))
+
+	resp, err := s.request(agentxOpen, e.b)
+	if err != nil {
+		return err
+	}
+	s.id = resp.sessionID
+	return nil
+}
+
+func (s *agentxSession) register() error {
+	e := s.encoder()
+	e.bytes(0, agentxPriority, 0, 0)
+	e.oid(s.p.baseOID, false)
+
+	_, err := s.request(agentxRegister, e.b)
+	return err
+}
+
+func (s *agentxSession) close(reason byte) {
+	err := s.send(&agentxPacket{
+		pduType:   agentxClose,
+		flags:     agentxFlagNetworkByteOrder,
+		sessionID: s.id,
+		packetID:  s.packetID.Add(1),
+		payload:   []byte{reason, 0, 0, 0},
+	})
+	if err != nil {
+		slog.Debug("failed to close agentx session", slog.Any("error", err))
+	}
+}
+
+// serve answers the requests of the master until the connection fails or
+// the master closes the session
+func (s *agentxSession) serve(ctx context.Context) error {
+	for {
+		pk, err := readAgentXPacket(s.conn)
+		if err != nil {
+			return err
+		}
+
+		switch pk.pduType {
+		case agentxResponse:
+			continue
+		case agentxClose:
+			return errors.New("agentx: session closed by master")
+		case agentxCleanupSet:
+			s.pending = nil
+			s.committed = false
+			continue
+		}
+
+		if err := s.send(s.respond(ctx, pk)); err != nil {
+			return err
+		}
+	}
+}
+
+// respond returns the Response PDU answering req
+func (s *agentxSession) respond(ctx context.Context, req *agentxPacket) *agentxPacket {
+	d := &agentxDecoder{b: req.payload, order: req.byteOrder()}
+
+	status, index, vbs, err := s.process(ctx, req, d)
+	if err != nil {
+		slog.Debug("failed to parse agentx request", "type", req.pduType, slog.Any("error", err))
+		status, index, vbs = agentxErrParseError, 0, nil
+	}
+
+	e := s.encoder()
+	// sysUpTime is ignored by the master
+	e.uint32(0)
+	e.uint16(uint16(status))
+	e.uint16(uint16(index))
+	for _, vb := range vbs {
+		e.varBind(vb)
+	}
+
+	return &agentxPacket{
+		pduType:       agentxResponse,
+		flags:         agentxFlagNetworkByteOrder,
+		sessionID:     req.sessionID,
+		transactionID: req.transactionID,
+		packetID:      req.packetID,
+		payload:       e.b,
+	}
+}
+
+// process returns the error status, error index and variables answering req
+func (s *agentxSession) process(ctx context.Context, req *agentxPacket, d *agentxDecoder) (int, int, []snmpVarBind, error) {
+	if req.flags&agentxFlagNonDefaultContext != 0 {
+		if _, err := d.octets(); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	switch req.pduType {
+	case agentxGet, agentxGetNext:
+		ranges, err := d.searchRanges()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+
+		s.p.ensureFresh(ctx)
+		snap := s.p.cache.Snapshot()
+
+		vbs := make([]snmpVarBind, 0, len(ranges))
+		for _, r := range ranges {
+			if req.pduType == agentxGet {
+				vbs = append(vbs, agentxGetVarBind(snap, r.start))
+				continue
+			}
+			next, _ := agentxNextVarBind(snap, r)
+			vbs = append(vbs, next)
+		}
+		return errNoError, 0, vbs, nil
+	case agentxGetBulk:
+		nonRepeaters, err := d.uint16()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		maxRepetitions, err := d.uint16()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		ranges, err := d.searchRanges()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+
+		s.p.ensureFresh(ctx)
+
+		return errNoError, 0, agentxBulk(s.p.cache.Snapshot(), int(nonRepeaters), int(maxRepetitions), ranges, agentxMaxPayload), nil
+	case agentxTestSet:
+		var vbs []snmpVarBind
+		for !d.empty() {
+			vb, err := d.varBind()
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			vbs = append(vbs, vb)
+		}
+		status, index := s.testSet(vbs)
+		return status, index, nil, nil
+	case agentxCommitSet:
+		status, index := s.commitSet()
+		return status, index, nil, nil
+	case agentxUndoSet:
+		// set handlers cannot be undone
+		if s.committed {
+			return errUndoFailed, 0, nil, nil
+		}
+		return errNoError, 0, nil, nil
+	case agentxPing:
+		return errNoError, 0, nil, nil
+	}
+
+	slog.Debug("unsupported agentx pdu", "type", req.pduType)
+	return agentxErrProcessingError, 0, nil, nil
+}
+
+func agentxGetVarBind(snap *Snapshot, oid OID) snmpVarBind {
+	v := snap.Get(oid)
+	if v == nil {
+		return snmpVarBind{oid: oid, tag: missingTag(snap, oid)}
+	}
+	return newSNMPVarBind(v)
+}
+
+// agentxNextVarBind returns the first entry in r or endOfMibView
+func agentxNextVarBind(snap *Snapshot, r agentxRange) (snmpVarBind, bool) {
+	if r.include {
+		if v := snap.Get(r.start); v != nil {
+			return newSNMPVarBind(v), true
+		}
+	}
+
+	v := snap.GetNext(r.start)
+	if v == nil || (len(r.end.Value) > 0 && v.OID.Compare(r.end) >= 0) {
+		return snmpVarBind{oid: r.start, tag: tagEndOfMibView}, false
+	}
+	return newSNMPVarBind(v), true
+}
+
+// agentxBulk answers a GetBulk request per RFC 2741 section 7.2.3.3,
+// repetitions stop once the encoded variables exceed maxSize
+func agentxBulk(snap *Snapshot, nonRepeaters int, maxRepetitions int, ranges []agentxRange, maxSize int) []snmpVarBind {
+	if nonRepeaters > len(ranges) {
+		nonRepeaters = len(ranges)
+	}
+
+	size := 0
+	var vbs []snmpVarBind
+	for _, r := range ranges[:nonRepeaters] {
+		next, _ := agentxNextVarBind(snap, r)
+		vbs = append(vbs, next)
+		size += agentxVarBindSize(next)
+	}
+
+	repeaters := append([]agentxRange(nil), ranges[nonRepeaters:]...)
+	maxRepetitions = capRepetitions(maxRepetitions, len(repeaters), maxSize)
+
+	for i := 0; i < maxRepetitions && len(repeaters) > 0; i++ {
+		more := false
+		for j, r := range repeaters {
+			next, ok := agentxNextVarBind(snap, r)
+			vbs = append(vbs, next)
+			if size += agentxVarBindSize(next); size > maxSize {
+				return vbs
+			}
+			repeaters[j].start = next.oid
+			repeaters[j].include = false
+			more = more || ok
+		}
+		if !more {
+			break
+		}
+	}
+
+	return vbs
+}
+
+// agentxVarBindSize returns the encoded length of vb
+func agentxVarBindSize(vb snmpVarBind) int {
+	e := agentxEncoder{order: binary.BigEndian}
+	e.varBind(vb)
+	return len(e.b)
+}
+
+// testSet checks the values of a set with the set handlers, they are called
+// on CommitSet
+func (s *agentxSession) testSet(vbs []snmpVarBind) (int, int) {
+	s.pending = nil
+	s.committed = false
+
+	for i, vb := range vbs {
+		h := s.p.findSetHandler(vb.oid)
+		if h == nil {
+			return errNotWritable, i + 1
+		}
+		if vb.value.Value == nil {
+			return errWrongType, i + 1
+		}
+
+		v := &VarBind{
+			OID:       vb.oid,
+			ValueType: vb.value.TypeString(),
+			Value:     vb.value,
+		}
+		if err := h.check(v); err != nil {
+			slog.Debug("set value rejected", "oid", vb.oid.String(), slog.Any("error", err))
+			return setErrorOf(err, GenError).errorStatus(), i + 1
+		}
+
+		s.pending = append(s.pending, &pendingSet{h, v})
+	}
+
+	return errNoError, 0
+}
+
+func (s *agentxSession) commitSet() (int, int) {
+	for i, ps := range s.pending {
+		slog.Debug("set", "oid", ps.vb.OID.String(), "value", ps.vb.Value.String())
+		if err := ps.h.fn(ps.vb); err != nil {
+			slog.Warn("set handler failed", "oid", ps.vb.OID.String(), slog.Any("error", err))
+			return errCommitFailed, i + 1
+		}
+		s.committed = true
+	}
+	return errNoError, 0
+}
@@ -0,0 +1,263 @@
+package passpersist
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// testMaster is a minimal AgentX master agent serving a single subagent. It
+// sends its requests in little endian byte order.
+type testMaster struct {
+	t        *testing.T
+	conn     net.Conn
+	session  uint32
+	packetID uint32
+}
+
+func (m *testMaster) read() *agentxPacket {
+	m.t.Helper()
+
+	pk, err := readAgentXPacket(m.conn)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return pk
+}
+
+func (m *testMaster) write(pk *agentxPacket) {
+	m.t.Helper()
+
+	if _, err := m.conn.Write(pk.marshal()); err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+// accept answers the Open and Register PDUs of the subagent
+func (m *testMaster) accept(base OID) {
+	m.t.Helper()
+
+	open := m.read()
+	if open.pduType != agentxOpen {
+		m.t.Fatalf("got pdu type %d, want Open", open.pduType)
+	}
+	m.reply(open)
+
+	reg := m.read()
+	if reg.pduType != agentxRegister || reg.sessionID != m.session {
+		m.t.Fatalf("got pdu type %d for session %d, want Register for %d", reg.pduType, reg.sessionID, m.session)
+	}
+
+	d := &agentxDecoder{b: reg.payload, order: reg.byteOrder()}
+	d.bytes(4)
+	subtree, _, err := d.oid()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	if !subtree.Equal(base) {
+		m.t.Fatalf("registered %s, want %s", subtree.String(), base.String())
+	}
+	m.reply(reg)
+}
+
+func (m *testMaster) reply(req *agentxPacket) {
+	m.t.Helper()
+
+	m.write(&agentxPacket{
+		pduType:   agentxResponse,
+		sessionID: m.session,
+		packetID:  req.packetID,
+		payload:   make([]byte, 8),
+	})
+}
+
+// request sends a PDU and returns the error status, error index and
+// variables of the response
+func (m *testMaster) request(pduType byte, encode func(e *agentxEncoder)) (int, int, []snmpVarBind) {
+	m.t.Helper()
+
+	e := &agentxEncoder{order: binary.LittleEndian}
+	if encode != nil {
+		encode(e)
+	}
+
+	m.packetID++
+	m.write(&agentxPacket{
+		pduType:   pduType,
+		sessionID: m.session,
+		packetID:  m.packetID,
+		payload:   e.b,
+	})
+
+	resp := m.read()
+	if resp.pduType != agentxResponse || resp.packetID != m.packetID {
+		m.t.Fatalf("got pdu type %d packet %d, want Response to %d", resp.pduType, resp.packetID, m.packetID)
+	}
+
+	d := &agentxDecoder{b: resp.payload, order: resp.byteOrder()}
+	d.uint32()
+	status, _ := d.uint16()
+	index, _ := d.uint16()
+
+	var vbs []snmpVarBind
+	for !d.empty() {
+		vb, err := d.varBind()
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		vbs = append(vbs, vb)
+	}
+	return int(status), int(index), vbs
+}
+
+func ranges(rs ...agentxRange) func(e *agentxEncoder) {
+	return func(e *agentxEncoder) {
+		for _, r := range rs {
+			e.oid(r.start, r.include)
+			e.oid(r.end, false)
+		}
+	}
+}
+
+func TestAgentX(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	base := MustNewOID("1.3.6.1.4.1.8072")
+	pp := NewPassPersist(
+		WithBaseOID(base),
+		WithAgentX("tcp", ln.Addr().String()),
+		WithArgs(nil),
+		WithRefreshSignals(),
+	)
+
+	sets := make(chan *VarBind, 1)
+	pp.MustOnSet([]int{2}, func(vb *VarBind) error {
+		sets <- vb
+		return nil
+	}, IntRange(Range{0, 10}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pp.RunContext(ctx, func(_ context.Context, pp *PassPersist) error {
+			pp.AddString([]int{1, 0}, "hello")
+			pp.AddInt([]int{2, 0}, -42)
+			pp.AddCounter64([]int{3, 0}, 1<<40)
+			return nil
+		})
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	m := &testMaster{t: t, conn: conn, session: 42}
+	m.accept(base)
+
+	oid := func(subs ...int) OID {
+		return base.MustAppend(subs)
+	}
+
+	// wait for the first update
+	for i := 0; ; i++ {
+		_, _, vbs := m.request(agentxGet, ranges(agentxRange{start: oid(2, 0)}))
+		if vbs[0].tag == tagInteger {
+			break
+		}
+		if i == 100 {
+			t.Fatal("cache was not populated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, _, vbs := m.request(agentxGet, ranges(
+		agentxRange{start: oid(2, 0)},
+		agentxRange{start: oid(2, 1)},
+		agentxRange{start: oid(9, 0)},
+	))
+	if len(vbs) != 3 || vbs[0].value.GetIntVal() != -42 || vbs[1].tag != tagNoSuchInstance || vbs[2].tag != tagNoSuchObject {
+		t.Errorf("get: unexpected response %+v", vbs)
+	}
+
+	_, _, vbs = m.request(agentxGetNext, ranges(
+		agentxRange{start: base},
+		agentxRange{start: oid(2, 0), include: true},
+		agentxRange{start: oid(2, 0), end: oid(3)},
+		agentxRange{start: oid(3, 0)},
+	))
+	if len(vbs) != 4 ||
+		string(vbs[0].value.GetOctetStringVal()) != "hello" ||
+		!vbs[1].oid.Equal(oid(2, 0)) ||
+		vbs[2].tag != tagEndOfMibView || !vbs[2].oid.Equal(oid(2, 0)) ||
+		vbs[3].tag != tagEndOfMibView {
+		t.Errorf("getnext: unexpected response %+v", vbs)
+	}
+
+	_, _, vbs = m.request(agentxGetBulk, func(e *agentxEncoder) {
+		e.uint16(1)
+		e.uint16(10)
+		ranges(agentxRange{start: oid(2, 0)}, agentxRange{start: base})(e)
+	})
+	want := []OID{oid(3, 0), oid(1, 0), oid(2, 0), oid(3, 0), oid(3, 0)}
+	if len(vbs) != len(want) {
+		t.Fatalf("getbulk: got %d variables, want %d", len(vbs), len(want))
+	}
+	for i, o := range want {
+		if !vbs[i].oid.Equal(o) {
+			t.Errorf("getbulk: variable %d is %s, want %s", i, vbs[i].oid.String(), o.String())
+		}
+	}
+	if vbs[3].value.GetCouter64Val() != 1<<40 || vbs[4].tag != tagEndOfMibView {
+		t.Errorf("getbulk: unexpected response %+v", vbs[3:])
+	}
+
+	testSet := func(o OID, v int32) (int, int) {
+		status, index, _ := m.request(agentxTestSet, func(e *agentxEncoder) {
+			e.varBind(snmpVarBind{oid: o, tag: tagInteger, value: typedValue{&IntVal{v}}})
+		})
+		return status, index
+	}
+
+	if status, index := testSet(oid(1, 0), 1); status != errNotWritable || index != 1 {
+		t.Errorf("set on read-only oid: got status %d index %d", status, index)
+	}
+	if status, _ := testSet(oid(2, 0), 50); status != errWrongValue {
+		t.Errorf("set out of range: got status %d, want %d", status, errWrongValue)
+	}
+	// CleanupSet is not answered
+	m.write(&agentxPacket{pduType: agentxCleanupSet, sessionID: m.session})
+
+	if status, _ := testSet(oid(2, 0), 5); status != errNoError {
+		t.Fatalf("set: test failed with status %d", status)
+	}
+	select {
+	case <-sets:
+		t.Error("set handler called before commit")
+	default:
+	}
+	if status, _, _ := m.request(agentxCommitSet, nil); status != errNoError {
+		t.Fatalf("set: commit failed with status %d", status)
+	}
+	if set := <-sets; set.Value.GetIntVal() != 5 {
+		t.Errorf("set handler got %+v", set)
+	}
+
+	cancel()
+
+	if pk := m.read(); pk.pduType != agentxClose || pk.payload[0] != agentxReasonShutdown {
+		t.Errorf("got pdu type %d, want Close on shutdown", pk.pduType)
+	}
+	<-done
+}
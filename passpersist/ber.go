@@ -0,0 +1,263 @@
+package passpersist
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// BER tags used by SNMP
+const (
+	tagInteger     byte = 0x02
+	tagOctetString byte = 0x04
+	tagNull        byte = 0x05
+	tagOID         byte = 0x06
+	tagSequence    byte = 0x30
+
+	tagIPAddress byte = 0x40
+	tagCounter32 byte = 0x41
+	tagGauge32   byte = 0x42
+	tagTimeTicks byte = 0x43
+	tagOpaque    byte = 0x44
+	tagCounter64 byte = 0x46
+
+	tagNoSuchObject   byte = 0x80
+	tagNoSuchInstance byte = 0x81
+	tagEndOfMibView   byte = 0x82
+)
+
+var errBERTruncated = errors.New("ber: truncated data")
+
+// berAppendLength appends a definite length in short or long form
+func berAppendLength(b []byte, n int) []byte {
+	if n < 0x80 {
+		return append(b, byte(n))
+	}
+
+	var l []byte
+	for ; n > 0; n >>= 8 {
+		l = append([]byte{byte(n)}, l...)
+	}
+	b = append(b, 0x80|byte(len(l)))
+	return append(b, l...)
+}
+
+// berTLV encodes content with tag
+func berTLV(tag byte, content []byte) []byte {
+	b := make([]byte, 0, len(content)+6)
+	b = append(b, tag)
+	b = berAppendLength(b, len(content))
+	return append(b, content...)
+}
+
+// berSequence encodes the concatenation of elems with tag
+func berSequence(tag byte, elems ...[]byte) []byte {
+	n := 0
+	for _, e := range elems {
+		n += len(e)
+	}
+	content := make([]byte, 0, n)
+	for _, e := range elems {
+		content = append(content, e...)
+	}
+	return berTLV(tag, content)
+}
+
+// berInt encodes a two's complement integer
+func berInt(tag byte, v int64) []byte {
+	n := 1
+	for i := v; i > 127 || i < -128; i >>= 8 {
+		n++
+	}
+	content := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		content[i] = byte(v)
+		v >>= 8
+	}
+	return berTLV(tag, content)
+}
+
+// berUint encodes an unsigned integer, prefixed by a zero octet when the
+// high bit is set
+func berUint(tag byte, v uint64) []byte {
+	var content []byte
+	for ; v > 0; v >>= 8 {
+		content = append([]byte{byte(v)}, content...)
+	}
+	if len(content) == 0 || content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berTLV(tag, content)
+}
+
+func berOctets(tag byte, v []byte) []byte {
+	return berTLV(tag, v)
+}
+
+func berNull(tag byte) []byte {
+	return []byte{tag, 0}
+}
+
+// berOID encodes an object identifier, the first two sub-ids are combined
+func berOID(o OID) []byte {
+	subs := o.Value
+	if len(subs) < 2 {
+		return berTLV(tagOID, nil)
+	}
+
+	content := berAppendSubID(nil, uint64(subs[0]*40+subs[1]))
+	for _, s := range subs[2:] {
+		content = berAppendSubID(content, uint64(s))
+	}
+	return berTLV(tagOID, content)
+}
+
+func berAppendSubID(b []byte, v uint64) []byte {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, tmp[i:]...)
+}
+
+// berReader decodes consecutive TLVs from a buffer
+type berReader struct {
+	b []byte
+}
+
+func (r *berReader) empty() bool {
+	return len(r.b) == 0
+}
+
+// next returns the tag and content of the next TLV
+func (r *berReader) next() (byte, []byte, error) {
+	if len(r.b) < 2 {
+		return 0, nil, errBERTruncated
+	}
+
+	tag := r.b[0]
+	n := int(r.b[1])
+	pos := 2
+
+	if n&0x80 != 0 {
+		octets := n & 0x7f
+		if octets == 0 || octets > 4 || len(r.b) < pos+octets {
+			return 0, nil, fmt.Errorf("ber: invalid length of tag 0x%02x", tag)
+		}
+		n = 0
+		for _, o := range r.b[pos : pos+octets] {
+			n = n<<8 | int(o)
+		}
+		pos += octets
+	}
+
+	if n < 0 || len(r.b) < pos+n {
+		return 0, nil, errBERTruncated
+	}
+
+	content := r.b[pos : pos+n]
+	r.b = r.b[pos+n:]
+	return tag, content, nil
+}
+
+// expect returns the content of the next TLV which must have tag
+func (r *berReader) expect(tag byte) ([]byte, error) {
+	t, content, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if t != tag {
+		return nil, fmt.Errorf("ber: expected tag 0x%02x, got 0x%02x", tag, t)
+	}
+	return content, nil
+}
+
+func (r *berReader) readInt(tag byte) (int64, error) {
+	content, err := r.expect(tag)
+	if err != nil {
+		return 0, err
+	}
+	return berParseInt(content)
+}
+
+func (r *berReader) readOctets(tag byte) ([]byte, error) {
+	return r.expect(tag)
+}
+
+func (r *berReader) readOID() (OID, error) {
+	content, err := r.expect(tagOID)
+	if err != nil {
+		return OID{}, err
+	}
+	return berParseOID(content)
+}
+
+func berParseInt(content []byte) (int64, error) {
+	if len(content) == 0 || len(content) > 8 {
+		return 0, fmt.Errorf("ber: invalid integer length %d", len(content))
+	}
+	v := int64(int8(content[0]))
+	for _, o := range content[1:] {
+		v = v<<8 | int64(o)
+	}
+	return v, nil
+}
+
+func berParseUint(content []byte) (uint64, error) {
+	if len(content) > 0 && content[0] == 0 {
+		content = content[1:]
+	}
+	if len(content) > 8 {
+		return 0, fmt.Errorf("ber: invalid unsigned length %d", len(content))
+	}
+	var v uint64
+	for _, o := range content {
+		v = v<<8 | uint64(o)
+	}
+	return v, nil
+}
+
+func berParseOID(content []byte) (OID, error) {
+	var subs []int
+	var v uint64
+	for i, o := range content {
+		v = v<<7 | uint64(o&0x7f)
+
+		// the first octets encode the first two sub-identifiers as 40*X+Y
+		limit := uint64(math.MaxUint32)
+		if len(subs) == 0 {
+			limit += 80
+		}
+		if v > limit {
+			return OID{}, fmt.Errorf("ber: sub-identifier out of range")
+		}
+
+		if o&0x80 != 0 {
+			if i == len(content)-1 {
+				return OID{}, errBERTruncated
+			}
+			continue
+		}
+		if len(subs) == 0 {
+			switch {
+			case v < 40:
+				subs = append(subs, 0, int(v))
+			case v < 80:
+				subs = append(subs, 1, int(v-40))
+			default:
+				subs = append(subs, 2, int(v-80))
+			}
+		} else {
+			subs = append(subs, int(v))
+		}
+		v = 0
+	}
+
+	if len(subs) < 2 {
+		return OID{}, fmt.Errorf("ber: invalid object identifier")
+	}
+	return OID{subs}, nil
+}
@@ -0,0 +1,90 @@
+package passpersist
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestBERInt(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 127, 128, -128, -129, 256, math.MaxInt32, math.MinInt32} {
+		r := &berReader{berInt(tagInteger, v)}
+		got, err := r.readInt(tagInteger)
+		if err != nil {
+			t.Errorf("failed to decode %d: %s", v, err)
+		} else if got != v {
+			t.Errorf("expected %d, got %d", v, got)
+		}
+	}
+}
+
+func TestBERUint(t *testing.T) {
+	if b := berUint(tagCounter32, 0x80); !bytes.Equal(b, []byte{0x41, 0x02, 0x00, 0x80}) {
+		t.Errorf("expected leading zero octet, got % x", b)
+	}
+
+	for _, v := range []uint64{0, 255, math.MaxUint32, math.MaxUint64} {
+		_, content, err := (&berReader{berUint(tagCounter64, v)}).next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := berParseUint(content)
+		if err != nil || got != v {
+			t.Errorf("expected %d, got %d (%v)", v, got, err)
+		}
+	}
+}
+
+func TestBEROID(t *testing.T) {
+	o := MustNewOID("1.3.6.1.4.1.8072.4294967295.0")
+
+	b := berOID(o)
+	if !bytes.Equal(b[:4], []byte{tagOID, byte(len(b) - 2), 0x2b, 0x06}) {
+		t.Errorf("unexpected encoding % x", b)
+	}
+
+	got, err := (&berReader{b}).readOID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(o) {
+		t.Errorf("expected %s, got %s", o, got)
+	}
+}
+
+func TestBERLongLength(t *testing.T) {
+	content := bytes.Repeat([]byte{'a'}, 300)
+	b := berOctets(tagOctetString, content)
+	if !bytes.Equal(b[:4], []byte{tagOctetString, 0x82, 0x01, 0x2c}) {
+		t.Errorf("unexpected length encoding % x", b[:4])
+	}
+
+	got, err := (&berReader{b}).readOctets(tagOctetString)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("failed to decode long octet string: %v", err)
+	}
+
+	if _, _, err := (&berReader{b[:100]}).next(); err == nil {
+		t.Errorf("expected error for truncated data")
+	}
+}
+
+func TestBERRange(t *testing.T) {
+	// 2^32 as the third sub-identifier of 1.3
+	if _, err := berParseOID([]byte{0x2b, 0x90, 0x80, 0x80, 0x80, 0x00}); err == nil {
+		t.Error("expected a sub-identifier above 2^32-1 to be rejected")
+	}
+	if _, err := berParseOID(bytes.Repeat([]byte{0xff}, 20)); err == nil {
+		t.Error("expected an overlong sub-identifier to be rejected")
+	}
+
+	if _, err := parseBERValue(tagInteger, []byte{0x01, 0x00, 0x00, 0x00, 0x00}); err == nil {
+		t.Error("expected an integer above 2^31-1 to be rejected")
+	}
+	if _, err := parseBERValue(tagGauge32, []byte{0x01, 0x00, 0x00, 0x00, 0x00}); err == nil {
+		t.Error("expected a gauge above 2^32-1 to be rejected")
+	}
+	if v, err := parseBERValue(tagInteger, []byte{0x80, 0x00, 0x00, 0x00}); err != nil || v.GetIntVal() != math.MinInt32 {
+		t.Errorf("expected %d, got %v (%v)", math.MinInt32, v, err)
+	}
+}
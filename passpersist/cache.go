@@ -3,117 +3,508 @@ package passpersist
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func NewCache() *Cache {
-	return &Cache{
-		staged:    make(map[string]*VarBind),
-		committed: make(map[string]*VarBind),
+	c := &Cache{
+		staged: make(map[string]*VarBind),
 	}
+	c.snapshot.Store(newSnapshot(0, nil))
+	return c
 }
 
+// Cache stages entries and publishes them as immutable snapshots. Readers
+// load the current snapshot atomically and never block writers.
 type Cache struct {
+	// RWMutex serializes staging and commits, holding its read lock keeps
+	// the committed entries from changing. Reads do not take it, they are
+	// answered from immutable snapshots.
 	sync.RWMutex
-	staged    map[string]*VarBind
-	committed map[string]*VarBind
-	index     OIDs
+	staged map[string]*VarBind
+	// ops are the incremental changes applied by Apply
+	ops      []cacheOp
+	snapshot atomic.Pointer[Snapshot]
+
+	subsMu sync.Mutex
+	subs   []*subscription
 }
 
-func (c *Cache) getIndex(o OID) (int, bool) {
-	for p, v := range c.index {
-		if v.Equal(o) {
-			return p, true
-		}
-	}
+// cacheOp is an upsert of vb or, when vb is nil, a deletion of oid or the
+// subtree below it
+type cacheOp struct {
+	oid     OID
+	vb      *VarBind
+	subtree bool
+}
 
-	for p, v := range c.index {
-		if v.StartsWith(o) {
-			return p - 1, true
+// splitOps returns the upserted entries and the deleted OIDs of ops
+func splitOps(ops []cacheOp) ([]*VarBind, []OID) {
+	var upserted []*VarBind
+	var deleted []OID
+	for _, op := range ops {
+		if op.vb != nil {
+			upserted = append(upserted, op.vb)
+		} else {
+			deleted = append(deleted, op.oid)
 		}
 	}
-	return 0, false
+	return upserted, deleted
 }
 
-func (c *Cache) Commit() {
-	c.Lock()
-	defer c.Unlock()
+// Snapshot is an immutable generation of committed entries, e.g. to answer
+// all the lookups of a walk from the same refresh
+type Snapshot struct {
+	generation uint64
+	time       time.Time
+	// stale counts the entries loaded from a file
+	stale   int
+	entries map[string]*VarBind
+	// index holds the entries sorted by OID
+	index []*VarBind
+}
 
-	slog.Debug("commiting cache...")
-	c.committed = c.staged
-	c.staged = make(map[string]*VarBind)
+func newSnapshot(generation uint64, entries map[string]*VarBind) *Snapshot {
+	if entries == nil {
+		entries = make(map[string]*VarBind)
+	}
 
-	// rebuild index
-	idx := make(OIDs, 0, len(c.committed))
-	for _, vb := range c.committed {
-		idx = append(idx, vb.OID)
+	index := make([]*VarBind, 0, len(entries))
+	for _, vb := range entries {
+		index = append(index, vb)
 	}
-	c.index = idx.Sort()
+	sort.Slice(index, func(i, j int) bool {
+		return index[i].OID.Compare(index[j].OID) < 0
+	})
 
-	//return nil
+	return &Snapshot{
+		generation: generation,
+		time:       time.Now(),
+		stale:      countStale(index),
+		entries:    entries,
+		index:      index,
+	}
 }
 
-func (c *Cache) DumpIndex() {
-	c.RLock()
-	defer c.RUnlock()
+func countStale(index []*VarBind) int {
+	n := 0
+	for _, vb := range index {
+		if vb.stale {
+			n++
+		}
+	}
+	return n
+}
 
-	slog.Debug("dumping cache index...")
-	slog.Debug("index:", slog.Any("index", c.index))
-	y, _ := json.MarshalIndent(c.index, "", "  ")
-	fmt.Println(string(y))
+// Generation is incremented by each commit
+func (s *Snapshot) Generation() uint64 {
+	return s.generation
 }
 
-func (c *Cache) Dump() {
-	c.RLock()
-	defer c.RUnlock()
+// Time returns when the entries were committed
+func (s *Snapshot) Time() time.Time {
+	return s.time
+}
 
-	o, _ := json.MarshalIndent(c.committed, "", "  ")
-	fmt.Println(string(o))
+// Stale returns true while some entries loaded from a file were not
+// updated since, see VarBind.Stale for those of a subtree
+func (s *Snapshot) Stale() bool {
+	return s.stale > 0
 }
 
-func (c *Cache) Get(oid OID) *VarBind {
-	c.RLock()
-	defer c.RUnlock()
+// Len returns the number of entries
+func (s *Snapshot) Len() int {
+	return len(s.index)
+}
 
+func (s *Snapshot) Get(oid OID) *VarBind {
 	slog.Debug("getting value at oid", "oid", oid.String())
-	if v, ok := c.committed[oid.String()]; ok {
+	if v, ok := s.entries[oid.String()]; ok {
 		slog.Debug("got value", "oid", oid.String(), "value", v.Value.String())
 		return v
 	}
 	return nil
 }
 
-func (c *Cache) GetNext(oid OID) *VarBind {
-	c.RLock()
-	defer c.RUnlock()
-
+// GetNext returns the entry following oid in lexicographic order, oid itself
+// does not need to exist.
+func (s *Snapshot) GetNext(oid OID) *VarBind {
 	slog.Debug("getting next value after", "oid", oid.String())
 
-	idx, found := c.getIndex(oid)
-	slog.Debug("got index at", "oid", oid.String(), "index", idx)
+	idx, found := s.nextIndex(oid)
 	if !found {
-		slog.Debug("index not found", "oid", oid.String())
+		slog.Debug("no entry after", "oid", oid.String(), "idxLen", len(s.index))
+		return nil
+	}
+
+	v := s.index[idx]
+	slog.Debug("got next entry", "oid", v.OID.String(), "val", v.Marshal())
+	return v
+}
+
+// Walk calls fn with the entries at and below prefix in OID order, an empty
+// prefix walks all entries. It stops at and returns the first error from fn.
+func (s *Snapshot) Walk(prefix OID, fn func(*VarBind) error) error {
+	for i := s.searchIndex(prefix); i < len(s.index) && s.index[i].OID.StartsWith(prefix); i++ {
+		if err := fn(s.index[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Iterator iterates over the entries of a snapshot in OID order:
+//
+//	for it := snap.Range(start, end); it.Next(); {
+//		vb := it.VarBind()
+//	}
+type Iterator struct {
+	index []*VarBind
+	pos   int
+}
+
+// Next advances to the next entry, it returns false when there are none left
+func (it *Iterator) Next() bool {
+	if it.pos >= len(it.index) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+// VarBind returns the current entry
+func (it *Iterator) VarBind() *VarBind {
+	if it.pos == 0 || it.pos > len(it.index) {
 		return nil
 	}
+	return it.index[it.pos-1]
+}
+
+// Range returns an iterator over the entries from start included to end
+// excluded, an empty start or end leaves the range unbounded on that side
+func (s *Snapshot) Range(start OID, end OID) *Iterator {
+	first := s.searchIndex(start)
+	last := len(s.index)
+	if len(end.Value) > 0 {
+		last = s.searchIndex(end)
+	}
+	if last < first {
+		last = first
+	}
+	return &Iterator{index: s.index[first:last]}
+}
+
+// searchIndex returns the position of the first indexed entry that is not
+// lexicographically less than o
+func (s *Snapshot) searchIndex(o OID) int {
+	return sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].OID.Compare(o) >= 0
+	})
+}
+
+// nextIndex returns the position of the first indexed entry that is
+// lexicographically greater than o using a binary search of the sorted index
+func (s *Snapshot) nextIndex(o OID) (int, bool) {
+	p := sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].OID.Compare(o) > 0
+	})
+	return p, p < len(s.index)
+}
+
+// Snapshot returns the current generation of committed entries
+func (c *Cache) Snapshot() *Snapshot {
+	return c.snapshot.Load()
+}
+
+// publish makes entries the next generation, the lock must be held
+func (c *Cache) publish(entries map[string]*VarBind) {
+	c.store(newSnapshot(c.Snapshot().generation+1, entries), nil)
+}
+
+func (c *Cache) Commit() {
+	c.Lock()
+	defer c.Unlock()
+
+	slog.Debug("commiting cache...")
+	staged := c.staged
+	c.staged = make(map[string]*VarBind)
+
+	c.publish(staged)
+}
+
+// CommitSubtree publishes the staged entries below prefix. Committed entries
+// below prefix are replaced unless they are also below one of exclude, all
+// other committed entries are kept.
+func (c *Cache) CommitSubtree(prefix OID, exclude ...OID) {
+	c.Lock()
+	defer c.Unlock()
+
+	staged := c.staged
+	c.staged = make(map[string]*VarBind)
+
+	c.commitSubtree(staged, prefix, exclude)
+}
+
+// commitSubtree publishes staged like CommitSubtree, the lock must be held
+func (c *Cache) commitSubtree(staged map[string]*VarBind, prefix OID, exclude []OID) {
+	slog.Debug("commiting subtree...", "prefix", prefix.String())
+
+	owned := func(o OID) bool {
+		return inSubtree(o, prefix, exclude)
+	}
+
+	current := c.Snapshot().entries
+	committed := make(map[string]*VarBind, len(current))
+	for k, vb := range current {
+		if !owned(vb.OID) {
+			committed[k] = vb
+		}
+	}
+
+	for k, vb := range staged {
+		if !owned(vb.OID) {
+			slog.Warn("dropping entry outside of subtree", "oid", vb.OID.String(), "prefix", prefix.String())
+			continue
+		}
+		committed[k] = vb
+	}
+
+	c.publish(committed)
+}
+
+// inSubtree returns true when o is at or below prefix but not below one of
+// exclude
+func inSubtree(o OID, prefix OID, exclude []OID) bool {
+	if !o.StartsWith(prefix) {
+		return false
+	}
+	for _, e := range exclude {
+		if o.StartsWith(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// takeStaged returns the staged entries and resets the staging area
+func (c *Cache) takeStaged() map[string]*VarBind {
+	c.Lock()
+	defer c.Unlock()
 
-	nidx := idx + 1
+	staged := c.staged
+	c.staged = make(map[string]*VarBind)
+	return staged
+}
 
-	slog.Debug("getting next after", "idx", idx, "next-idx", nidx)
+// Discard drops the staged entries and changes
+func (c *Cache) Discard() {
+	c.Lock()
+	defer c.Unlock()
+
+	slog.Debug("discarding staged entries", "count", len(c.staged), "changes", len(c.ops))
+	c.staged = make(map[string]*VarBind)
+	c.ops = nil
+}
+
+// Upsert stages v to be added, or to replace the entry at the same OID, by
+// the next Apply
+func (c *Cache) Upsert(v *VarBind) {
+	c.Lock()
+	defer c.Unlock()
+
+	slog.Debug("staging upsert", slog.Any("value", v.Marshal()))
+	vb := *v
+	vb.updated = time.Now()
+	c.ops = append(c.ops, cacheOp{oid: v.OID, vb: &vb})
+}
+
+// Delete stages the removal of the entry at oid by the next Apply
+func (c *Cache) Delete(oid OID) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ops = append(c.ops, cacheOp{oid: oid})
+}
+
+// DeleteSubtree stages the removal of the entries at and below prefix by
+// the next Apply
+func (c *Cache) DeleteSubtree(prefix OID) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ops = append(c.ops, cacheOp{oid: prefix, subtree: true})
+}
+
+// Apply publishes the staged upserts and deletions, in the order they were
+// made, on top of the committed entries. Unlike Commit other entries are
+// kept.
+func (c *Cache) Apply() {
+	c.Lock()
+	defer c.Unlock()
+
+	ops := c.ops
+	c.ops = nil
+
+	c.applyOps(ops, nil)
+}
+
+// takeOps returns the staged changes and resets them
+func (c *Cache) takeOps() []cacheOp {
+	c.Lock()
+	defer c.Unlock()
+
+	ops := c.ops
+	c.ops = nil
+	return ops
+}
+
+// applyOps publishes ops as the next generation, dropping changes outside
+// of owned if given. The index of the current snapshot is merged with the
+// changed entries rather than sorted again. The lock must be held.
+func (c *Cache) applyOps(ops []cacheOp, owned func(OID) bool) {
+	if len(ops) == 0 {
+		return
+	}
+
+	type change struct {
+		oid OID
+		vb  *VarBind
+	}
 
-	if nidx < len(c.index) {
-		next := c.index[nidx]
-		if v, ok := c.committed[next.String()]; ok {
-			slog.Debug("got next entry", "oid", next.String(), "val", v.Marshal())
-			return v
+	cur := c.Snapshot()
+
+	// the final state of each changed OID, nil when deleted
+	changes := make(map[string]*change)
+	for _, op := range ops {
+		if owned != nil && !owned(op.oid) {
+			slog.Warn("dropping change outside of subtree", "oid", op.oid.String())
+			continue
+		}
+
+		if !op.subtree {
+			changes[op.oid.String()] = &change{op.oid, op.vb}
+			continue
+		}
+
+		for _, ch := range changes {
+			if ch.oid.StartsWith(op.oid) {
+				ch.vb = nil
+			}
+		}
+		for i := cur.searchIndex(op.oid); i < len(cur.index) && cur.index[i].OID.StartsWith(op.oid); i++ {
+			o := cur.index[i].OID
+			if owned == nil || owned(o) {
+				changes[o.String()] = &change{o, nil}
+			}
+		}
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	entries := make(map[string]*VarBind, len(cur.entries)+len(changes))
+	for k, vb := range cur.entries {
+		entries[k] = vb
+	}
+
+	// replaced maps positions in the current index to their new entry
+	replaced := make(map[int]*VarBind)
+	var added []*VarBind
+	for k, ch := range changes {
+		_, existed := cur.entries[k]
+		if ch.vb == nil {
+			delete(entries, k)
 		} else {
-			slog.Debug("no entry for oid", "oid", next.String())
+			entries[k] = ch.vb
+		}
+
+		if existed {
+			replaced[cur.searchIndex(ch.oid)] = ch.vb
+		} else if ch.vb != nil {
+			added = append(added, ch.vb)
 		}
-	} else {
-		slog.Debug("index out of bounds", "idxLen", len(c.index), "idx", idx)
 	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].OID.Compare(added[j].OID) < 0
+	})
 
-	return nil
+	index := make([]*VarBind, 0, len(entries))
+	j := 0
+	for i, vb := range cur.index {
+		if r, ok := replaced[i]; ok {
+			if r == nil {
+				continue
+			}
+			vb = r
+		}
+		for ; j < len(added) && added[j].OID.Compare(vb.OID) < 0; j++ {
+			index = append(index, added[j])
+		}
+		index = append(index, vb)
+	}
+	index = append(index, added[j:]...)
+
+	changed := make([]OID, 0, len(changes))
+	for _, ch := range changes {
+		changed = append(changed, ch.oid)
+	}
+
+	c.store(&Snapshot{
+		generation: cur.generation + 1,
+		time:       time.Now(),
+		stale:      countStale(index),
+		entries:    entries,
+		index:      index,
+	}, changed)
+}
+
+func (c *Cache) DumpIndex(w io.Writer) {
+	s := c.Snapshot()
+
+	index := make(OIDs, len(s.index))
+	for i, vb := range s.index {
+		index[i] = vb.OID
+	}
+
+	slog.Debug("dumping cache index...")
+	slog.Debug("index:", slog.Any("index", index))
+	y, _ := json.MarshalIndent(index, "", "  ")
+	fmt.Fprintln(w, string(y))
+}
+
+func (c *Cache) Dump(w io.Writer) {
+	o, _ := json.MarshalIndent(c.Snapshot().entries, "", "  ")
+	fmt.Fprintln(w, string(o))
+}
+
+// Get returns the committed entry at oid from the current snapshot
+func (c *Cache) Get(oid OID) *VarBind {
+	return c.Snapshot().Get(oid)
+}
+
+// GetNext returns the committed entry following oid in lexicographic order
+// from the current snapshot, oid itself does not need to exist. Use Snapshot
+// to keep successive lookups on the same generation.
+func (c *Cache) GetNext(oid OID) *VarBind {
+	return c.Snapshot().GetNext(oid)
+}
+
+// Walk walks the committed entries at and below prefix of the current
+// snapshot, see Snapshot.Walk
+func (c *Cache) Walk(prefix OID, fn func(*VarBind) error) error {
+	return c.Snapshot().Walk(prefix, fn)
+}
+
+// Range iterates over the committed entries from start to end of the
+// current snapshot, see Snapshot.Range
+func (c *Cache) Range(start OID, end OID) *Iterator {
+	return c.Snapshot().Range(start, end)
 }
 
 func (c *Cache) Set(v *VarBind) {
@@ -122,5 +513,7 @@ func (c *Cache) Set(v *VarBind) {
 
 	slog.Debug("staging", slog.Any("value", v.Marshal()))
 
-	c.staged[v.OID.String()] = v
+	vb := *v
+	vb.updated = time.Now()
+	c.staged[v.OID.String()] = &vb
 }
@@ -1,6 +1,12 @@
 package passpersist
 
-import "testing"
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestCacheSet(t *testing.T) {
 	c := NewCache()
@@ -23,7 +29,288 @@ func TestCacheSet(t *testing.T) {
 		if !c.Get(vb.OID).OID.Equal(vb.OID) {
 			t.Errorf("var binds do not match")
 		}
+		if !vb.updated.IsZero() {
+			t.Errorf("the caller's var bind was modified")
+		}
+	}
+
+	c.Dump(os.Stdout)
+}
+
+func TestCacheGetNext(t *testing.T) {
+	c := NewCache()
+	for _, o := range []string{
+		"1.3.6.1.4.1.8072.1.1",
+		"1.3.6.1.4.1.8072.1.3",
+		"1.3.6.1.4.1.8072.2.1.5",
+		"1.3.6.1.4.1.8072.10",
+	} {
+		c.Set(&VarBind{
+			OID:       MustNewOID(o),
+			ValueType: "STRING",
+			Value:     typedValue{Value: &StringVal{Value: o}},
+		})
+	}
+	c.Commit()
+
+	tests := []struct {
+		oid  string
+		want string
+	}{
+		{"1.3.6.1.4.1.8072", "1.3.6.1.4.1.8072.1.1"},
+		{"1.3.6.1.4.1.8072.0.9", "1.3.6.1.4.1.8072.1.1"},
+		{"1.3.6.1.4.1.8072.1.1", "1.3.6.1.4.1.8072.1.3"},
+		{"1.3.6.1.4.1.8072.1.2", "1.3.6.1.4.1.8072.1.3"},
+		{"1.3.6.1.4.1.8072.1.1.7.8", "1.3.6.1.4.1.8072.1.3"},
+		{"1.3.6.1.4.1.8072.1.3", "1.3.6.1.4.1.8072.2.1.5"},
+		{"1.3.6.1.4.1.8072.2", "1.3.6.1.4.1.8072.2.1.5"},
+		{"1.3.6.1.4.1.8072.3", "1.3.6.1.4.1.8072.10"},
+		{"1.3.6.1.4.1.8072.10", ""},
+		{"1.3.6.1.4.1.8072.11", ""},
+	}
+
+	for _, tt := range tests {
+		vb := c.GetNext(MustNewOID(tt.oid))
+		got := ""
+		if vb != nil {
+			got = vb.OID.String()
+		}
+		if got != tt.want {
+			t.Errorf("getnext %s: expected '%s', got '%s'", tt.oid, tt.want, got)
+		}
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	c := NewCache()
+	base := MustNewOID("1.3.6.1.4.1.8072")
+
+	commit := func(n int) {
+		for i := 1; i <= n; i++ {
+			c.Set(&VarBind{
+				OID:       base.MustAppend([]int{i}),
+				ValueType: "INTEGER",
+				Value:     typedValue{Value: &IntVal{Value: int32(n)}},
+			})
+		}
+		c.Commit()
+	}
+
+	if g := c.Snapshot().Generation(); g != 0 {
+		t.Errorf("empty cache generation is %d, want 0", g)
 	}
 
-	c.Dump()
+	commit(3)
+	snap := c.Snapshot()
+	commit(5)
+
+	if snap.Generation() != 1 || c.Snapshot().Generation() != 2 {
+		t.Errorf("got generations %d and %d, want 1 and 2", snap.Generation(), c.Snapshot().Generation())
+	}
+
+	// a walk of the pinned snapshot is not affected by the later commit
+	n := 0
+	for vb := snap.GetNext(base); vb != nil; vb = snap.GetNext(vb.OID) {
+		if vb.Value.GetIntVal() != 3 {
+			t.Errorf("%s is from another generation", vb.OID.String())
+		}
+		n++
+	}
+	if n != 3 || snap.Len() != 3 {
+		t.Errorf("walked %d of %d entries, want 3", n, snap.Len())
+	}
+	if c.Snapshot().Len() != 5 {
+		t.Errorf("current snapshot has %d entries, want 5", c.Snapshot().Len())
+	}
+}
+
+func TestCacheApply(t *testing.T) {
+	c := NewCache()
+	base := MustNewOID("1.3.6.1.4.1.8072")
+
+	upsert := func(value string, subs ...int) {
+		c.Upsert(&VarBind{
+			OID:       base.MustAppend(subs),
+			ValueType: "STRING",
+			Value:     typedValue{Value: &StringVal{Value: value}},
+		})
+	}
+
+	walk := func() []string {
+		var got []string
+		for vb := c.GetNext(base); vb != nil; vb = c.GetNext(vb.OID) {
+			got = append(got, vb.OID.String()+"="+vb.Value.String())
+		}
+		return got
+	}
+
+	upsert("a", 1)
+	upsert("b", 2, 1)
+	upsert("c", 2, 2)
+	upsert("d", 10)
+	c.Apply()
+
+	upsert("e", 3)
+	upsert("a2", 1)
+	c.Delete(base.MustAppend([]int{10}))
+	upsert("f", 2, 3)
+	c.DeleteSubtree(base.MustAppend([]int{2}))
+	upsert("g", 2, 0)
+	upsert("h", 0)
+	c.Apply()
+
+	want := []string{
+		"1.3.6.1.4.1.8072.0=h",
+		"1.3.6.1.4.1.8072.1=a2",
+		"1.3.6.1.4.1.8072.2.0=g",
+		"1.3.6.1.4.1.8072.3=e",
+	}
+	got := walk()
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if c.Snapshot().Len() != len(want) || c.Snapshot().Generation() != 2 {
+		t.Errorf("got %d entries at generation %d", c.Snapshot().Len(), c.Snapshot().Generation())
+	}
+	if c.Get(base.MustAppend([]int{2, 1})) != nil {
+		t.Error("deleted subtree entry is still committed")
+	}
+
+	// nothing staged, nothing published
+	c.Apply()
+	if c.Snapshot().Generation() != 2 {
+		t.Error("empty apply published a generation")
+	}
+}
+
+func benchmarkCacheWalk(b *testing.B, rows int) {
+	c := NewCache()
+	base := MustNewOID("1.3.6.1.4.1.8072.1.3.1.226")
+	for col := 1; col <= 4; col++ {
+		for row := 1; row <= rows/4; row++ {
+			c.Set(&VarBind{
+				OID:       base.MustAppend([]int{1, col, row}),
+				ValueType: "Counter64",
+				Value:     typedValue{Value: &Counter64Val{Value: uint64(row)}},
+			})
+		}
+	}
+	c.Commit()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		for vb := c.GetNext(base); vb != nil; vb = c.GetNext(vb.OID) {
+			n++
+		}
+		if n != rows {
+			b.Fatalf("expected to walk %d entries, got %d", rows, n)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*rows), "ns/entry")
+}
+
+func BenchmarkCacheWalk1k(b *testing.B)   { benchmarkCacheWalk(b, 1000) }
+func BenchmarkCacheWalk10k(b *testing.B)  { benchmarkCacheWalk(b, 10000) }
+func BenchmarkCacheWalk100k(b *testing.B) { benchmarkCacheWalk(b, 100000) }
+
+func TestCacheWalk(t *testing.T) {
+	c := NewCache()
+	for _, o := range []string{
+		"1.3.6.1.4.1.8072.1.1",
+		"1.3.6.1.4.1.8072.1.3",
+		"1.3.6.1.4.1.8072.2.1.5",
+		"1.3.6.1.4.1.8072.10",
+	} {
+		c.Set(&VarBind{
+			OID:       MustNewOID(o),
+			ValueType: "STRING",
+			Value:     typedValue{Value: &StringVal{Value: o}},
+		})
+	}
+	c.Commit()
+
+	walk := func(prefix string) string {
+		var got []string
+		var o OID
+		if prefix != "" {
+			o = MustNewOID(prefix)
+		}
+		c.Walk(o, func(vb *VarBind) error {
+			got = append(got, vb.OID.String())
+			return nil
+		})
+		return strings.Join(got, " ")
+	}
+
+	iterate := func(start, end string) string {
+		var s, e OID
+		if start != "" {
+			s = MustNewOID(start)
+		}
+		if end != "" {
+			e = MustNewOID(end)
+		}
+		var got []string
+		for it := c.Range(s, e); it.Next(); {
+			got = append(got, it.VarBind().OID.String())
+		}
+		return strings.Join(got, " ")
+	}
+
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{walk(""), "1.3.6.1.4.1.8072.1.1 1.3.6.1.4.1.8072.1.3 1.3.6.1.4.1.8072.2.1.5 1.3.6.1.4.1.8072.10"},
+		{walk("1.3.6.1.4.1.8072.1"), "1.3.6.1.4.1.8072.1.1 1.3.6.1.4.1.8072.1.3"},
+		{walk("1.3.6.1.4.1.8072.2.1.5"), "1.3.6.1.4.1.8072.2.1.5"},
+		{walk("1.3.6.1.4.1.8072.3"), ""},
+		{iterate("", ""), "1.3.6.1.4.1.8072.1.1 1.3.6.1.4.1.8072.1.3 1.3.6.1.4.1.8072.2.1.5 1.3.6.1.4.1.8072.10"},
+		{iterate("1.3.6.1.4.1.8072.1.2", "1.3.6.1.4.1.8072.10"), "1.3.6.1.4.1.8072.1.3 1.3.6.1.4.1.8072.2.1.5"},
+		{iterate("1.3.6.1.4.1.8072.1.3", ""), "1.3.6.1.4.1.8072.1.3 1.3.6.1.4.1.8072.2.1.5 1.3.6.1.4.1.8072.10"},
+		{iterate("1.3.6.1.4.1.8072.10", "1.3.6.1.4.1.8072.1"), ""},
+	}
+	for i, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%d: got '%s', want '%s'", i, tt.got, tt.want)
+		}
+	}
+
+	errStop := errors.New("stop")
+	n := 0
+	err := c.Walk(OID{}, func(vb *VarBind) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Errorf("walk did not stop: %v after %d entries", err, n)
+	}
+}
+
+func TestCacheLock(t *testing.T) {
+	c := NewCache()
+	o := MustNewOID("1.3.6.1.4.1.8072.1")
+	c.Set(&VarBind{OID: o, ValueType: "string", Value: typedValue{&StringVal{"old"}}})
+	c.Commit()
+
+	// the embedded lock still keeps commits out while it is held
+	c.RLock()
+	done := make(chan struct{})
+	go func() {
+		c.Set(&VarBind{OID: o, ValueType: "string", Value: typedValue{&StringVal{"new"}}})
+		c.Commit()
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if got := c.Get(o).Value.String(); got != "old" {
+		t.Errorf("expected the committed entry to be kept while locked, got '%s'", got)
+	}
+	c.RUnlock()
+
+	<-done
+	if got := c.Get(o).Value.String(); got != "new" {
+		t.Errorf("expected the entry to be committed once unlocked, got '%s'", got)
+	}
 }
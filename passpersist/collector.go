@@ -0,0 +1,298 @@
+package passpersist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+type collector struct {
+	oid      OID
+	interval time.Duration
+	fn       func(context.Context, *PassPersist) error
+	exclude  []OID
+	// trigger requests a refresh, a non nil channel is closed once it is
+	// done
+	trigger chan chan struct{}
+	lastRun atomic.Int64
+}
+
+// AddCollector registers f to refresh the subtree at subs every interval,
+// independently of other collectors. f receives a PassPersist rooted at the
+// subtree, so the subs passed to its Add methods are relative to subs, and
+// each update only replaces the entries of that subtree. Subtrees of more
+// specific collectors are left to them.
+//
+// Collectors must be added before Run is called.
+func (p *PassPersist) AddCollector(subs []int, interval time.Duration, f func(context.Context, *PassPersist) error) error {
+	if len(subs) == 0 {
+		return fmt.Errorf("collector subtree is required, use Run to collect the base OID")
+	}
+
+	oid, err := p.baseOID.Append(subs)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range p.collectors {
+		if c.oid.Equal(oid) {
+			return fmt.Errorf("a collector is already registered for '%s'", oid.String())
+		}
+	}
+
+	p.collectors = append(p.collectors, &collector{
+		oid:      oid,
+		interval: interval,
+		fn:       f,
+	})
+
+	return nil
+}
+
+func (p *PassPersist) MustAddCollector(subs []int, interval time.Duration, f func(context.Context, *PassPersist) error) {
+	err := p.AddCollector(subs, interval, f)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// collectorsWith returns the registered collectors plus f, if not nil, as
+// the collector of the base OID. The subtrees of nested collectors are
+// excluded from their parents.
+func (p *PassPersist) collectorsWith(f func(context.Context, *PassPersist) error) []*collector {
+	collectors := make([]*collector, 0, len(p.collectors)+1)
+	if f != nil {
+		collectors = append(collectors, &collector{
+			oid:      p.baseOID,
+			interval: p.refreshRate,
+			fn:       f,
+		})
+	}
+	collectors = append(collectors, p.collectors...)
+
+	for _, c := range collectors {
+		if c.trigger == nil {
+			c.trigger = make(chan chan struct{}, 1)
+		}
+		c.exclude = nil
+		for _, o := range collectors {
+			if o != c && len(o.oid.Value) > len(c.oid.Value) && o.oid.StartsWith(c.oid) {
+				c.exclude = append(c.exclude, o.oid)
+			}
+		}
+	}
+
+	return collectors
+}
+
+// owns returns true when oid is updated by c and not a nested collector
+func (c *collector) owns(oid OID) bool {
+	return inSubtree(oid, c.oid, c.exclude)
+}
+
+// view returns a PassPersist rooted at oid with its own staging area
+func (p *PassPersist) view(oid OID) *PassPersist {
+	return &PassPersist{
+		root:          p.owner(),
+		cache:         NewCache(),
+		baseOID:       oid,
+		refreshRate:   p.refreshRate,
+		updateTimeout: p.updateTimeout,
+		in:            p.in,
+		out:           p.out,
+		notify:        p.notify,
+		incremental:   p.incremental,
+	}
+}
+
+// owner returns the PassPersist p is a view of, or p itself
+func (p *PassPersist) owner() *PassPersist {
+	if p.root != nil {
+		return p.root
+	}
+	return p
+}
+
+// start runs the collectors in the background until ctx is done
+func (p *PassPersist) start(ctx context.Context, collectors []*collector) {
+	p.loadPersisted()
+
+	if p.persistPath != "" {
+		go func() {
+			<-ctx.Done()
+			p.flushPersisted()
+		}()
+	}
+
+	p.runMu.Lock()
+	p.running = collectors
+	p.runMu.Unlock()
+
+	for _, c := range collectors {
+		go p.collect(ctx, c)
+	}
+
+	if len(p.ttls) > 0 {
+		go p.expireLoop(ctx)
+	}
+
+	if len(p.refreshSignals) > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, p.refreshSignals...)
+
+		go func() {
+			defer signal.Stop(sigs)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case sig := <-sigs:
+					slog.Info("refresh requested", "signal", sig.String())
+					p.Refresh()
+				}
+			}
+		}()
+	}
+}
+
+// Refresh asks all running collectors to update now instead of waiting for
+// their next interval. It does not wait for the updates to complete.
+func (p *PassPersist) Refresh() {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+
+	for _, c := range p.running {
+		select {
+		case c.trigger <- nil:
+		default:
+			// a refresh is already pending
+		}
+	}
+}
+
+// ensureFresh refreshes collectors which last ran more than maxAge ago and
+// waits for them to complete, at most maxAgeWait so that a hung collector
+// does not stall requests
+func (p *PassPersist) ensureFresh(ctx context.Context) {
+	if p.maxAge <= 0 {
+		return
+	}
+
+	p.runMu.Lock()
+	running := p.running
+	p.runMu.Unlock()
+
+	timer := time.NewTimer(p.maxAgeWait)
+	defer timer.Stop()
+
+	var pending []chan struct{}
+	for _, c := range running {
+		if time.Since(time.Unix(0, c.lastRun.Load())) <= p.maxAge {
+			continue
+		}
+		done := make(chan struct{})
+		select {
+		case c.trigger <- done:
+			pending = append(pending, done)
+		case <-timer.C:
+			slog.Warn("refresh not started in time, answering from committed entries", "oid", c.oid.String())
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-timer.C:
+			slog.Warn("refresh not done in time, answering from committed entries")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PassPersist) collect(ctx context.Context, c *collector) {
+	var waiting []chan struct{}
+
+	for {
+		timer := time.NewTimer(c.interval)
+
+		p.refresh(ctx, c)
+
+		for _, done := range waiting {
+			close(done)
+		}
+		waiting = nil
+
+		select {
+		case <-timer.C:
+		case done := <-c.trigger:
+			timer.Stop()
+			if done != nil {
+				waiting = append(waiting, done)
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// refresh runs the collector in a transaction which is committed on success,
+// on failure it is aborted and the committed entries are kept
+func (p *PassPersist) refresh(ctx context.Context, c *collector) {
+	c.lastRun.Store(time.Now().UnixNano())
+
+	tx := p.begin(c)
+
+	err := p.runCallback(ctx, tx.view, c.fn)
+	if err != nil {
+		slog.Error("update failed, keeping last committed entries", "oid", c.oid.String(), slog.Any("error", err))
+		tx.Abort()
+	} else if err = tx.Commit(); errors.Is(err, errTxDone) {
+		// the callback committed or aborted the transaction itself
+		err = nil
+	} else if err != nil {
+		slog.Error("commit failed", "oid", c.oid.String(), slog.Any("error", err))
+	}
+	p.recordUpdate(err)
+}
+
+// runCallback runs callback on target with the update timeout, recovering
+// from panics. A callback overrunning the timeout is abandoned, it should
+// stop adding entries once its context is done, they are dropped with its
+// aborted transaction.
+func (p *PassPersist) runCallback(ctx context.Context, target *PassPersist, callback func(context.Context, *PassPersist) error) error {
+	if p.updateTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.updateTimeout)
+		defer cancel()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("update panicked", slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+				errc <- fmt.Errorf("update panicked: %v", r)
+			}
+		}()
+		errc <- callback(ctx, target)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("update abandoned: %w", ctx.Err())
+	}
+}
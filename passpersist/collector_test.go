@@ -0,0 +1,211 @@
+package passpersist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCollectorsKeepOtherSubtrees(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+	ctx := context.Background()
+
+	counters := 0
+	pp.MustAddCollector([]int{2}, time.Second, func(_ context.Context, pp *PassPersist) error {
+		counters++
+		pp.MustAddCounter32([]int{1}, uint32(counters))
+		return nil
+	})
+	pp.MustAddCollector([]int{3}, time.Minute, func(_ context.Context, pp *PassPersist) error {
+		pp.MustAddString([]int{1}, "inventory")
+		return nil
+	})
+
+	if err := pp.AddCollector([]int{3}, time.Minute, nil); err == nil {
+		t.Errorf("expected duplicate collector to be rejected")
+	}
+
+	collectors := pp.collectorsWith(func(_ context.Context, pp *PassPersist) error {
+		pp.MustAddString([]int{1}, "base")
+		pp.MustAddString([]int{2, 9}, "ignored")
+		return nil
+	})
+
+	for _, c := range collectors {
+		pp.refresh(ctx, c)
+	}
+
+	// refresh counters again, the other subtrees must be kept
+	pp.refresh(ctx, collectors[1])
+
+	tests := map[string]string{
+		"1.3.6.1.4.1.8072.1":   "base",
+		"1.3.6.1.4.1.8072.2.1": "2",
+		"1.3.6.1.4.1.8072.3.1": "inventory",
+	}
+	for o, want := range tests {
+		v := pp.get(MustNewOID(o))
+		if v == nil {
+			t.Errorf("missing entry at %s", o)
+		} else if v.Value.String() != want {
+			t.Errorf("expected '%s' at %s, got '%s'", want, o, v.Value.String())
+		}
+	}
+
+	if v := pp.get(MustNewOID("1.3.6.1.4.1.8072.2.9")); v != nil {
+		t.Errorf("base collector should not write into the counters subtree")
+	}
+
+	// a failed base refresh keeps everything
+	pp.refresh(ctx, pp.collectorsWith(func(_ context.Context, pp *PassPersist) error {
+		return errors.New("failed")
+	})[0])
+
+	if v := pp.get(MustNewOID("1.3.6.1.4.1.8072.1")); v == nil {
+		t.Errorf("expected base entry to be kept after failed update")
+	}
+}
+
+func TestIncrementalCollectors(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")), WithIncremental())
+	ctx := context.Background()
+
+	if err := NewPassPersist().Delete([]int{1}); err == nil {
+		t.Error("expected delete to be rejected without incremental mode")
+	}
+
+	cycle := 0
+	pp.MustAddCollector([]int{2}, time.Minute, func(_ context.Context, pp *PassPersist) error {
+		cycle++
+		if cycle == 1 {
+			pp.MustAddString([]int{1}, "first")
+			pp.MustAddString([]int{2, 1}, "row")
+			pp.MustAddString([]int{2, 2}, "row")
+			return nil
+		}
+		pp.MustAddString([]int{3}, "second")
+		pp.Delete([]int{1})
+		return pp.DeleteSubtree([]int{2})
+	})
+
+	collectors := pp.collectorsWith(func(_ context.Context, pp *PassPersist) error {
+		return pp.AddString([]int{1}, "base")
+	})
+	for _, c := range collectors {
+		pp.refresh(ctx, c)
+	}
+	pp.refresh(ctx, collectors[1])
+
+	// the base entry is kept and only the changes of the second cycle are
+	// applied
+	want := "1.3.6.1.4.1.8072.1=base 1.3.6.1.4.1.8072.2.3=second"
+	var got []string
+	for vb := pp.getNext(pp.baseOID); vb != nil; vb = pp.getNext(vb.OID) {
+		got = append(got, vb.OID.String()+"="+vb.Value.String())
+	}
+	if strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pp := NewPassPersist(
+		WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+		WithRefreshSignals(),
+	)
+
+	var runs atomic.Int32
+	updated := make(chan struct{}, 10)
+	pp.start(ctx, pp.collectorsWith(func(_ context.Context, pp *PassPersist) error {
+		runs.Add(1)
+		updated <- struct{}{}
+		return nil
+	}))
+
+	<-updated
+	pp.Refresh()
+
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatalf("expected Refresh to trigger an update")
+	}
+
+	if n := runs.Load(); n != 2 {
+		t.Errorf("expected 2 updates, got %d", n)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := strings.NewReader("get\n1.3.6.1.4.1.8072.1\nget\n1.3.6.1.4.1.8072.1\n")
+	out := &bytes.Buffer{}
+
+	pp := NewPassPersist(
+		WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+		WithRefresh(time.Hour),
+		WithMaxAge(time.Nanosecond),
+		WithInput(in),
+		WithOutput(out),
+	)
+
+	var runs atomic.Int32
+	pp.RunContext(ctx, func(_ context.Context, pp *PassPersist) error {
+		pp.MustAddInt([]int{1}, runs.Add(1))
+		return nil
+	})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+	if lines[2] == lines[5] {
+		t.Errorf("expected stale entries to be refreshed before each get, got %q", out.String())
+	}
+}
+
+func TestMaxAgeHungCollector(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := strings.NewReader("get\n1.3.6.1.4.1.8072.1\n")
+	out := &bytes.Buffer{}
+
+	pp := NewPassPersist(
+		WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+		WithRefresh(time.Hour),
+		WithMaxAge(time.Nanosecond),
+		WithMaxAgeWait(50*time.Millisecond),
+		WithInput(in),
+		WithOutput(out),
+	)
+
+	block := make(chan struct{})
+	defer close(block)
+
+	var runs atomic.Int32
+	start := time.Now()
+	pp.RunContext(ctx, func(_ context.Context, pp *PassPersist) error {
+		if runs.Add(1) > 1 {
+			<-block
+		}
+		pp.MustAddString([]int{1}, "committed")
+		return nil
+	})
+
+	if time.Since(start) > time.Second {
+		t.Error("get waited for the hung collector")
+	}
+	if !strings.Contains(out.String(), "committed") {
+		t.Errorf("expected the committed entry to be served, got %q", out.String())
+	}
+}
@@ -0,0 +1,118 @@
+package passpersist
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constraint validates the value of a set request before it reaches the
+// SetHandler. A failing constraint returns a SetError which is reported back
+// to snmpd.
+type Constraint func(*VarBind) error
+
+// Range is an inclusive range of values or sizes
+type Range struct {
+	Min int64
+	Max int64
+}
+
+func (r Range) contains(i int64) bool {
+	return i >= r.Min && i <= r.Max
+}
+
+// containsValue reports whether the numeric value v is within the range
+func (r Range) containsValue(v *typedValue) bool {
+	lo, _ := v.compareInt(r.Min)
+	hi, _ := v.compareInt(r.Max)
+	return lo >= 0 && hi <= 0
+}
+
+// AllowTypes rejects values whose SMI type is not one of types with
+// WrongType. Type names are matched case insensitively and accept the common
+// aliases, e.g. "STRING" and "OCTET" both match an OCTET STRING.
+func AllowTypes(types ...string) Constraint {
+	allowed := make(map[string]bool, len(types))
+	for _, t := range types {
+		allowed[smiType(t)] = true
+	}
+
+	return func(vb *VarBind) error {
+		t := vb.Value.TypeString()
+		if !allowed[smiType(t)] {
+			return fmt.Errorf("%w: type %s is not allowed", WrongType, t)
+		}
+		return nil
+	}
+}
+
+// IntRange rejects numeric values outside of all ranges with WrongValue and
+// non numeric values with WrongType.
+func IntRange(ranges ...Range) Constraint {
+	return func(vb *VarBind) error {
+		if _, ok := vb.Value.compareInt(0); !ok {
+			return fmt.Errorf("%w: %s is not numeric", WrongType, vb.Value.TypeString())
+		}
+		for _, r := range ranges {
+			if r.containsValue(&vb.Value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s is out of range", WrongValue, vb.Value.String())
+	}
+}
+
+// SizeRange rejects strings whose length is outside of all ranges with
+// WrongLength and non string values with WrongType.
+func SizeRange(ranges ...Range) Constraint {
+	return func(vb *VarBind) error {
+		n, ok := vb.Value.size()
+		if !ok {
+			return fmt.Errorf("%w: %s is not a string", WrongType, vb.Value.TypeString())
+		}
+		for _, r := range ranges {
+			if r.contains(int64(n)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: length %d is out of range", WrongLength, n)
+	}
+}
+
+// Enum rejects numeric values not in values with WrongValue and non numeric
+// values with WrongType.
+func Enum(values ...int64) Constraint {
+	return func(vb *VarBind) error {
+		if _, ok := vb.Value.compareInt(0); !ok {
+			return fmt.Errorf("%w: %s is not numeric", WrongType, vb.Value.TypeString())
+		}
+		for _, v := range values {
+			if c, _ := vb.Value.compareInt(v); c == 0 {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s is not an enumerated value", WrongValue, vb.Value.String())
+	}
+}
+
+// smiType normalizes type names to their SMI type
+func smiType(t string) string {
+	switch strings.ToUpper(t) {
+	case "STRING", "OCTET", "OCTETSTRING", "OCTET STRING":
+		return "OCTET STRING"
+	case "INTEGER", "INTEGER32", "INT":
+		return "INTEGER"
+	case "COUNTER", "COUNTER32":
+		return "Counter32"
+	case "COUNTER64":
+		return "Counter64"
+	case "GAUGE", "GAUGE32", "UNSIGNED", "UNSIGNED32":
+		return "Gauge32"
+	case "TIMETICKS":
+		return "TimeTicks"
+	case "IPADDRESS":
+		return "IpAddress"
+	case "OBJECTID", "OID", "OBJECT IDENTIFIER":
+		return "OBJECT IDENTIFIER"
+	}
+	return t
+}
@@ -0,0 +1,75 @@
+package passpersist
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConstraints(t *testing.T) {
+	tests := []struct {
+		name       string
+		constraint Constraint
+		line       string
+		want       error
+	}{
+		{"type ok", AllowTypes("INTEGER"), "integer 1", nil},
+		{"type alias", AllowTypes("STRING"), "octet \"01 02\"", nil},
+		{"wrong type", AllowTypes("INTEGER"), "string \"x\"", WrongType},
+		{"in range", IntRange(Range{1, 5}, Range{10, 20}), "integer 15", nil},
+		{"out of range", IntRange(Range{1, 5}), "integer 6", WrongValue},
+		{"counter64 above int64", IntRange(Range{0, 100}), "counter64 18446744073709551615", WrongValue},
+		{"counter64 in range", IntRange(Range{0, 100}), "counter64 100", nil},
+		{"range wrong type", IntRange(Range{1, 5}), "string \"1\"", WrongType},
+		{"size ok", SizeRange(Range{0, 4}), "string \"abcd\"", nil},
+		{"too long", SizeRange(Range{0, 4}), "string \"abcde\"", WrongLength},
+		{"enum ok", Enum(1, 2), "integer 2", nil},
+		{"not enum", Enum(1, 2), "integer 3", WrongValue},
+		{"counter64 not enum", Enum(-1), "counter64 18446744073709551615", WrongValue},
+	}
+
+	for _, tt := range tests {
+		tv, err := parseTypedValue(tt.line)
+		if err != nil {
+			t.Fatalf("%s: failed to parse '%s': %s", tt.name, tt.line, err)
+		}
+
+		err = tt.constraint(&VarBind{Value: tv})
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %s, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestSetConstraints(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	called := false
+	pp.MustOnSet([]int{1}, func(vb *VarBind) error {
+		called = true
+		if vb.Value.GetIntVal() == 3 {
+			return InconsistentValue
+		}
+		return nil
+	}, AllowTypes("INTEGER"), Enum(1, 2, 3))
+
+	if r := pp.set("1.3.6.1.4.1.8072.1", "string \"up\""); r != "wrong-type" {
+		t.Errorf("expected wrong-type, got %s", r)
+	}
+	if r := pp.set("1.3.6.1.4.1.8072.1", "integer 4"); r != "wrong-value" {
+		t.Errorf("expected wrong-value, got %s", r)
+	}
+	if called {
+		t.Errorf("handler should not be called for rejected values")
+	}
+	if r := pp.set("1.3.6.1.4.1.8072.1", "integer 3"); r != "inconsistent-value" {
+		t.Errorf("expected inconsistent-value, got %s", r)
+	}
+	if r := pp.set("1.3.6.1.4.1.8072.1", "integer abc"); r != "wrong-value" {
+		t.Errorf("expected wrong-value, got %s", r)
+	}
+	if r := pp.set("1.3.6.1.4.1.8072.1", "integer 1"); r != "DONE" {
+		t.Errorf("expected DONE, got %s", r)
+	}
+}
@@ -0,0 +1,181 @@
+package passpersist
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// octetFormat is a single octet-format specification of a DISPLAY-HINT
+type octetFormat struct {
+	repeat     bool
+	length     int
+	format     byte
+	separator  byte
+	terminator byte
+}
+
+func parseOctetHint(hint string) ([]octetFormat, error) {
+	var specs []octetFormat
+	for i := 0; i < len(hint); {
+		var f octetFormat
+		if hint[i] == '*' {
+			f.repeat = true
+			i++
+		}
+
+		j := i
+		for j < len(hint) && hint[j] >= '0' && hint[j] <= '9' {
+			j++
+		}
+		if j == i || j == len(hint) {
+			return nil, fmt.Errorf("invalid display hint '%s'", hint)
+		}
+		f.length, _ = strconv.Atoi(hint[i:j])
+		if f.length == 0 && !f.repeat {
+			// would never consume the octets
+			return nil, fmt.Errorf("invalid display hint '%s', zero length", hint)
+		}
+
+		f.format = hint[j]
+		if !strings.ContainsRune("dxoat", rune(f.format)) {
+			return nil, fmt.Errorf("invalid display hint format '%c'", f.format)
+		}
+		i = j + 1
+
+		isSep := func(c byte) bool { return c != '*' && (c < '0' || c > '9') }
+		if i < len(hint) && isSep(hint[i]) {
+			f.separator = hint[i]
+			i++
+			if f.repeat && i < len(hint) && isSep(hint[i]) {
+				f.terminator = hint[i]
+				i++
+			}
+		}
+
+		specs = append(specs, f)
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("empty display hint")
+	}
+	return specs, nil
+}
+
+// formatOctets renders b following an octet string DISPLAY-HINT of RFC 2579
+// §3.1, e.g. "1x:" for a MAC address or "255a" for text. The last
+// specification is applied until b is consumed.
+func formatOctets(hint string, b []byte) (string, error) {
+	specs, err := parseOctetHint(hint)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for i := 0; len(b) > 0; i++ {
+		f := specs[len(specs)-1]
+		if i < len(specs) {
+			f = specs[i]
+		}
+
+		count := 1
+		if f.repeat {
+			count = int(b[0])
+			b = b[1:]
+		}
+
+		for r := 0; r < count && len(b) > 0; r++ {
+			n := f.length
+			if n > len(b) {
+				n = len(b)
+			}
+			chunk := b[:n]
+			b = b[n:]
+
+			switch f.format {
+			case 'a', 't':
+				sb.Write(chunk)
+			case 'd':
+				sb.WriteString(new(big.Int).SetBytes(chunk).String())
+			case 'x':
+				sb.WriteString(fmt.Sprintf("%0*s", 2*n, new(big.Int).SetBytes(chunk).Text(16)))
+			case 'o':
+				sb.WriteString(new(big.Int).SetBytes(chunk).Text(8))
+			}
+
+			last := len(b) == 0 || (f.terminator != 0 && r == count-1)
+			if f.separator != 0 && !last {
+				sb.WriteByte(f.separator)
+			}
+		}
+
+		if f.terminator != 0 && len(b) > 0 {
+			sb.WriteByte(f.terminator)
+		}
+	}
+	return sb.String(), nil
+}
+
+// formatInt renders i following an integer DISPLAY-HINT of RFC 2579 §3.1:
+// "d" optionally followed by "-" and the number of decimals, "x", "o" or
+// "b"
+func formatInt(hint string, i int64) (string, error) {
+	if i >= 0 {
+		return formatUint(hint, uint64(i))
+	}
+	// -i overflows for the minimum int64 but its conversion is still right
+	s, err := formatUint(hint, uint64(-i))
+	if err != nil {
+		return "", err
+	}
+	return "-" + s, nil
+}
+
+// formatUint renders u like formatInt, for the values of unsigned types
+// above the maximum int64
+func formatUint(hint string, u uint64) (string, error) {
+	switch hint {
+	case "x":
+		return strconv.FormatUint(u, 16), nil
+	case "o":
+		return strconv.FormatUint(u, 8), nil
+	case "b":
+		return strconv.FormatUint(u, 2), nil
+	case "d":
+		return strconv.FormatUint(u, 10), nil
+	}
+
+	if !strings.HasPrefix(hint, "d-") {
+		return "", fmt.Errorf("invalid display hint '%s'", hint)
+	}
+	decimals, err := strconv.Atoi(hint[2:])
+	if err != nil || decimals < 0 {
+		return "", fmt.Errorf("invalid display hint '%s'", hint)
+	}
+
+	s := fmt.Sprintf("%0*d", decimals+1, u)
+	if decimals == 0 {
+		return s, nil
+	}
+	return s[:len(s)-decimals] + "." + s[len(s)-decimals:], nil
+}
+
+// formatDisplayHint renders integers with an integer hint and strings or
+// byte slices with an octet string hint
+func formatDisplayHint(hint string, v any) (string, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return formatInt(hint, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return formatUint(hint, rv.Uint())
+	}
+
+	b, err := toBytes(v)
+	if err != nil {
+		return "", err
+	}
+	return formatOctets(hint, b)
+}
@@ -0,0 +1,260 @@
+package passpersist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+)
+
+// InetAddressType values of RFC 4001
+const (
+	inetUnknown = 0
+	inetIPv4    = 1
+	inetIPv6    = 2
+	inetIPv4z   = 3
+	inetIPv6z   = 4
+)
+
+// Index concatenates the encoded components of a table INDEX, e.g.
+//
+//	pp.AddString(Index([]int{2, 1, 3}, OctetStringIndex([]byte("eth0"))), "up")
+func Index(parts ...[]int) []int {
+	var subs []int
+	for _, p := range parts {
+		subs = append(subs, p...)
+	}
+	return subs
+}
+
+// AppendIndex returns the OID followed by the encoded INDEX components
+func (v OID) AppendIndex(parts ...[]int) (OID, error) {
+	return v.Append(Index(parts...))
+}
+
+// IntIndex encodes an integer index as a single sub-identifier
+func IntIndex(i uint32) []int {
+	return []int{int(i)}
+}
+
+// OctetStringIndex encodes a variable length OCTET STRING index, preceded
+// by its length
+func OctetStringIndex(b []byte) []int {
+	return append([]int{len(b)}, FixedOctetStringIndex(b)...)
+}
+
+// ImpliedOctetStringIndex encodes the last, IMPLIED, OCTET STRING index
+// without its length
+func ImpliedOctetStringIndex(b []byte) []int {
+	return FixedOctetStringIndex(b)
+}
+
+// FixedOctetStringIndex encodes a fixed length OCTET STRING index, one
+// sub-identifier per octet
+func FixedOctetStringIndex(b []byte) []int {
+	subs := make([]int, len(b))
+	for i, c := range b {
+		subs[i] = int(c)
+	}
+	return subs
+}
+
+// IPAddressIndex encodes an IpAddress index as its 4 octets, it fails on
+// IPv6 addresses and the zero Addr
+func IPAddressIndex(a netip.Addr) ([]int, error) {
+	if !a.Unmap().Is4() {
+		return nil, fmt.Errorf("not an IPv4 address: '%s'", a)
+	}
+	b := a.Unmap().As4()
+	return FixedOctetStringIndex(b[:]), nil
+}
+
+// MustIPAddressIndex is like IPAddressIndex but panics on error
+func MustIPAddressIndex(a netip.Addr) []int {
+	subs, err := IPAddressIndex(a)
+	if err != nil {
+		panic(err)
+	}
+	return subs
+}
+
+// InetAddressIndex encodes an InetAddressType and InetAddress pair of
+// indexes. A numeric zone selects the ipv4z and ipv6z types, other zones are
+// ignored. The zero Addr is encoded as unknown with an empty address.
+func InetAddressIndex(a netip.Addr) []int {
+	if !a.IsValid() {
+		return []int{inetUnknown, 0}
+	}
+
+	zone, err := strconv.ParseUint(a.Zone(), 10, 32)
+	zoned := a.Zone() != "" && err == nil
+
+	var typ int
+	var b []byte
+	if a.Is4() {
+		b4 := a.As4()
+		typ, b = inetIPv4, b4[:]
+	} else {
+		b16 := a.As16()
+		typ, b = inetIPv6, b16[:]
+	}
+	if zoned {
+		typ += inetIPv4z - inetIPv4
+		b = binary.BigEndian.AppendUint32(b, uint32(zone))
+	}
+
+	return Index(IntIndex(uint32(typ)), OctetStringIndex(b))
+}
+
+// OIDIndex encodes an OBJECT IDENTIFIER index, preceded by its number of
+// sub-identifiers
+func OIDIndex(o OID) []int {
+	return append([]int{len(o.Value)}, o.Value...)
+}
+
+// ImpliedOIDIndex encodes the last, IMPLIED, OBJECT IDENTIFIER index
+// without its length
+func ImpliedOIDIndex(o OID) []int {
+	return append([]int{}, o.Value...)
+}
+
+// IndexDecoder decodes the INDEX components of a requested OID in order
+type IndexDecoder struct {
+	subs []int
+}
+
+// NewIndexDecoder returns a decoder of the index of oid following prefix,
+// e.g. the OID of a column
+func NewIndexDecoder(prefix OID, oid OID) (*IndexDecoder, error) {
+	if !oid.StartsWith(prefix) {
+		return nil, fmt.Errorf("'%s' is not below '%s'", oid.String(), prefix.String())
+	}
+	return &IndexDecoder{oid.Value[len(prefix.Value):]}, nil
+}
+
+// Len returns the number of sub-identifiers left
+func (d *IndexDecoder) Len() int {
+	return len(d.subs)
+}
+
+// Done returns an error unless the whole index was decoded
+func (d *IndexDecoder) Done() error {
+	if len(d.subs) > 0 {
+		return fmt.Errorf("%d trailing index sub-identifiers", len(d.subs))
+	}
+	return nil
+}
+
+func (d *IndexDecoder) take(n int) ([]int, error) {
+	if n > len(d.subs) {
+		return nil, fmt.Errorf("index too short, %d sub-identifiers left, need %d", len(d.subs), n)
+	}
+	subs := d.subs[:n]
+	d.subs = d.subs[n:]
+	return subs, nil
+}
+
+// Int decodes an integer index
+func (d *IndexDecoder) Int() (uint32, error) {
+	subs, err := d.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(subs[0]), nil
+}
+
+func octets(subs []int) ([]byte, error) {
+	b := make([]byte, len(subs))
+	for i, s := range subs {
+		if s < 0 || s > 255 {
+			return nil, fmt.Errorf("index sub-identifier %d is not an octet", s)
+		}
+		b[i] = byte(s)
+	}
+	return b, nil
+}
+
+// OctetString decodes a variable length OCTET STRING index
+func (d *IndexDecoder) OctetString() ([]byte, error) {
+	n, err := d.Int()
+	if err != nil {
+		return nil, err
+	}
+	return d.FixedOctetString(int(n))
+}
+
+// ImpliedOctetString decodes the last, IMPLIED, OCTET STRING index
+func (d *IndexDecoder) ImpliedOctetString() ([]byte, error) {
+	return d.FixedOctetString(len(d.subs))
+}
+
+// FixedOctetString decodes a fixed length OCTET STRING index of n octets
+func (d *IndexDecoder) FixedOctetString(n int) ([]byte, error) {
+	subs, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+	return octets(subs)
+}
+
+// IPAddress decodes an IpAddress index
+func (d *IndexDecoder) IPAddress() (netip.Addr, error) {
+	b, err := d.FixedOctetString(4)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.AddrFrom4([4]byte(b)), nil
+}
+
+// InetAddress decodes an InetAddressType and InetAddress pair of indexes,
+// unknown addresses are decoded as the zero Addr
+func (d *IndexDecoder) InetAddress() (netip.Addr, error) {
+	typ, err := d.Int()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	b, err := d.OctetString()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	want := map[uint32]int{inetUnknown: 0, inetIPv4: 4, inetIPv6: 16, inetIPv4z: 8, inetIPv6z: 20}
+	n, ok := want[typ]
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("unsupported InetAddressType %d", typ)
+	}
+	if len(b) != n {
+		return netip.Addr{}, fmt.Errorf("InetAddress of type %d has %d octets, want %d", typ, len(b), n)
+	}
+
+	var a netip.Addr
+	switch typ {
+	case inetIPv4, inetIPv4z:
+		a = netip.AddrFrom4([4]byte(b[:4]))
+	case inetIPv6, inetIPv6z:
+		a = netip.AddrFrom16([16]byte(b[:16]))
+	}
+	if typ == inetIPv4z || typ == inetIPv6z {
+		a = a.WithZone(strconv.FormatUint(uint64(binary.BigEndian.Uint32(b[n-4:])), 10))
+	}
+	return a, nil
+}
+
+// OID decodes an OBJECT IDENTIFIER index
+func (d *IndexDecoder) OID() (OID, error) {
+	n, err := d.Int()
+	if err != nil {
+		return OID{}, err
+	}
+	subs, err := d.take(int(n))
+	if err != nil {
+		return OID{}, err
+	}
+	return OID{append([]int{}, subs...)}, nil
+}
+
+// ImpliedOID decodes the last, IMPLIED, OBJECT IDENTIFIER index
+func (d *IndexDecoder) ImpliedOID() (OID, error) {
+	subs, _ := d.take(len(d.subs))
+	return OID{append([]int{}, subs...)}, nil
+}
@@ -0,0 +1,122 @@
+package passpersist
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestIndexEncode(t *testing.T) {
+	tests := []struct {
+		got  []int
+		want string
+	}{
+		{IntIndex(42), "[42]"},
+		{OctetStringIndex([]byte("ab")), "[2 97 98]"},
+		{ImpliedOctetStringIndex([]byte("ab")), "[97 98]"},
+		{FixedOctetStringIndex([]byte{0, 255}), "[0 255]"},
+		{MustIPAddressIndex(netip.MustParseAddr("10.0.0.1")), "[10 0 0 1]"},
+		{MustIPAddressIndex(netip.MustParseAddr("::ffff:10.0.0.1")), "[10 0 0 1]"},
+		{InetAddressIndex(netip.MustParseAddr("10.0.0.1")), "[1 4 10 0 0 1]"},
+		{InetAddressIndex(netip.MustParseAddr("fe80::1%3")), "[4 20 254 128 0 0 0 0 0 0 0 0 0 0 0 0 0 1 0 0 0 3]"},
+		{InetAddressIndex(netip.Addr{}), "[0 0]"},
+		{OIDIndex(MustNewOID("1.3.6")), "[3 1 3 6]"},
+		{ImpliedOIDIndex(MustNewOID("1.3.6")), "[1 3 6]"},
+		{Index(IntIndex(1), OctetStringIndex([]byte("a"))), "[1 1 97]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.got); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestIPAddressIndexInvalid(t *testing.T) {
+	for _, a := range []netip.Addr{{}, netip.MustParseAddr("2001:db8::1")} {
+		if subs, err := IPAddressIndex(a); err == nil {
+			t.Errorf("%s: expected an error, got %v", a, subs)
+		}
+	}
+}
+
+func TestIndexDecode(t *testing.T) {
+	column := MustNewOID("1.3.6.1.4.1.8072.2.1.1")
+	addr := netip.MustParseAddr("2001:db8::1")
+	oid, err := column.AppendIndex(
+		IntIndex(7),
+		OctetStringIndex([]byte("eth0")),
+		MustIPAddressIndex(netip.MustParseAddr("192.0.2.1")),
+		InetAddressIndex(addr),
+		OIDIndex(MustNewOID("1.3.6.1")),
+		ImpliedOctetStringIndex([]byte("end")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewIndexDecoder(column, oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := d.Int()
+	if err != nil || i != 7 {
+		t.Errorf("int: got %d, %v", i, err)
+	}
+	s, err := d.OctetString()
+	if err != nil || string(s) != "eth0" {
+		t.Errorf("string: got %q, %v", s, err)
+	}
+	ip, err := d.IPAddress()
+	if err != nil || ip.String() != "192.0.2.1" {
+		t.Errorf("ip: got %s, %v", ip, err)
+	}
+	inet, err := d.InetAddress()
+	if err != nil || inet != addr {
+		t.Errorf("inet: got %s, %v", inet, err)
+	}
+	o, err := d.OID()
+	if err != nil || o.String() != "1.3.6.1" {
+		t.Errorf("oid: got %s, %v", o.String(), err)
+	}
+	s, err = d.ImpliedOctetString()
+	if err != nil || string(s) != "end" {
+		t.Errorf("implied: got %q, %v", s, err)
+	}
+	if err := d.Done(); err != nil {
+		t.Error(err)
+	}
+
+	zoned, _ := NewIndexDecoder(column, column.MustAppend(InetAddressIndex(netip.MustParseAddr("fe80::1%3"))))
+	if a, err := zoned.InetAddress(); err != nil || a.String() != "fe80::1%3" {
+		t.Errorf("zoned: got %s, %v", a, err)
+	}
+
+	errors := []struct {
+		subs   []int
+		decode func(*IndexDecoder) error
+	}{
+		// too short
+		{[]int{5, 1, 2}, func(d *IndexDecoder) error { _, err := d.OctetString(); return err }},
+		// not an octet
+		{[]int{1, 256}, func(d *IndexDecoder) error { _, err := d.OctetString(); return err }},
+		// wrong InetAddress length
+		{[]int{1, 3, 1, 2, 3}, func(d *IndexDecoder) error { _, err := d.InetAddress(); return err }},
+		// trailing sub-identifiers
+		{[]int{1, 2}, func(d *IndexDecoder) error { d.Int(); return d.Done() }},
+	}
+	for _, tt := range errors {
+		d, _ := NewIndexDecoder(column, column.MustAppend(tt.subs))
+		if err := tt.decode(d); err == nil {
+			t.Errorf("%v: expected an error", tt.subs)
+		}
+	}
+
+	if _, err := (&IndexDecoder{[]int{-1}}).FixedOctetString(1); err == nil {
+		t.Error("expected an error for a negative sub-identifier")
+	}
+
+	if _, err := NewIndexDecoder(column, MustNewOID("1.3.6.1.4.1.8072.3.1")); err == nil {
+		t.Error("expected an error for an OID outside of the prefix")
+	}
+}
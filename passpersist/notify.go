@@ -0,0 +1,233 @@
+package passpersist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// notificationQueueSize bounds the notifications of rules waiting to be sent
+const notificationQueueSize = 64
+
+var (
+	sysUpTimeOID   = MustNewOID("1.3.6.1.2.1.1.3.0")
+	snmpTrapOIDOID = MustNewOID("1.3.6.1.6.3.1.1.4.1.0")
+)
+
+// notificationReceiver is a manager notifications are sent to
+type notificationReceiver struct {
+	addr      string
+	community string
+	inform    bool
+	timeout   time.Duration
+	retries   int
+}
+
+// notifier holds the receivers shared by a PassPersist and its collector
+// views
+type notifier struct {
+	receivers []notificationReceiver
+	startTime time.Time
+	requestID atomic.Uint32
+
+	queueOnce sync.Once
+	queue     chan queuedNotification
+}
+
+// queuedNotification is a notification of a rule waiting to be sent
+type queuedNotification struct {
+	trapOID OID
+	vb      *VarBind
+}
+
+func newNotifier() *notifier {
+	n := &notifier{startTime: time.Now()}
+
+	var id [4]byte
+	rand.Read(id[:])
+	n.requestID.Store(binary.BigEndian.Uint32(id[:]))
+
+	return n
+}
+
+// WithTrapReceiver sends notifications to addr as SNMPv2c traps using
+// community. The port defaults to 162.
+func WithTrapReceiver(addr, community string) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.notify.receivers = append(p.notify.receivers, notificationReceiver{
+			addr:      withDefaultPort(addr, "162"),
+			community: community,
+		})
+	}
+}
+
+// WithInformReceiver sends notifications to addr as SNMPv2c informs using
+// community. Informs not acknowledged within timeout, 5 seconds when zero,
+// are sent again up to retries times. The port defaults to 162.
+func WithInformReceiver(addr, community string, timeout time.Duration, retries int) func(*PassPersist) {
+	return func(p *PassPersist) {
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		p.notify.receivers = append(p.notify.receivers, notificationReceiver{
+			addr:      withDefaultPort(addr, "162"),
+			community: community,
+			inform:    true,
+			timeout:   timeout,
+			retries:   retries,
+		})
+	}
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, port)
+	}
+	return addr
+}
+
+// queueTrap sends a notification from a background goroutine, in order, so
+// that unreachable receivers do not hold up commits. The notification is
+// dropped when the queue is full.
+func (p *PassPersist) queueTrap(trapOID OID, vb *VarBind) {
+	n := p.notify
+	n.queueOnce.Do(func() {
+		n.queue = make(chan queuedNotification, notificationQueueSize)
+		go func() {
+			for q := range n.queue {
+				// failures are logged by SendTrapContext
+				p.SendTrapContext(context.Background(), q.trapOID, q.vb)
+			}
+		}()
+	})
+
+	select {
+	case n.queue <- queuedNotification{trapOID, vb}:
+	default:
+		slog.Warn("notification queue full, dropping notification", "trap", trapOID.String())
+	}
+}
+
+// SendTrap sends a notification identified by trapOID with vbs to all
+// receivers, see SendTrapContext
+func (p *PassPersist) SendTrap(trapOID OID, vbs ...*VarBind) error {
+	return p.SendTrapContext(context.Background(), trapOID, vbs...)
+}
+
+// SendTrapContext sends a notification identified by trapOID with vbs to all
+// receivers, preceded by sysUpTime.0 and snmpTrapOID.0. It returns once
+// traps are sent and informs are acknowledged, retried out or ctx is done.
+func (p *PassPersist) SendTrapContext(ctx context.Context, trapOID OID, vbs ...*VarBind) error {
+	n := p.notify
+
+	varBinds := make([]snmpVarBind, 0, len(vbs)+2)
+	varBinds = append(varBinds,
+		snmpVarBind{
+			oid:   sysUpTimeOID,
+			tag:   tagTimeTicks,
+			value: typedValue{&TimeTicksVal{time.Since(n.startTime)}},
+		},
+		snmpVarBind{
+			oid:   snmpTrapOIDOID,
+			tag:   tagOID,
+			value: typedValue{&OIDVal{trapOID}},
+		},
+	)
+	for _, vb := range vbs {
+		// allows passing the result of a Cache lookup which missed
+		if vb == nil {
+			continue
+		}
+		varBinds = append(varBinds, newSNMPVarBind(vb))
+	}
+
+	var errs []error
+	for _, r := range n.receivers {
+		pdu := &snmpPDU{
+			tag:       pduTrapV2,
+			requestID: int32(n.requestID.Add(1) & 0x7fffffff),
+			varBinds:  varBinds,
+		}
+		if r.inform {
+			pdu.tag = pduInformRequest
+		}
+
+		if err := r.send(ctx, pdu); err != nil {
+			slog.Warn("failed to send notification", "receiver", r.addr, "trap", trapOID.String(), slog.Any("error", err))
+			errs = append(errs, fmt.Errorf("%s: %w", r.addr, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// send delivers pdu to the receiver, waiting for the response to informs
+func (r *notificationReceiver) send(ctx context.Context, pdu *snmpPDU) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", r.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	b := (&snmpMessage{version: snmpV2c, community: r.community, pdu: pdu}).marshal()
+
+	if !r.inform {
+		_, err := conn.Write(b)
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for try := 0; try <= r.retries; try++ {
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(r.timeout))
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return err
+			}
+
+			msg, err := unmarshalMessage(buf[:n])
+			if err != nil || msg.pdu.tag != pduResponse || msg.pdu.requestID != pdu.requestID {
+				continue
+			}
+			return nil
+		}
+
+		slog.Debug("inform timed out", "receiver", r.addr, "try", try+1)
+	}
+
+	return errors.New("inform not acknowledged")
+}
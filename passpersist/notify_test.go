@@ -0,0 +1,116 @@
+package passpersist
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenReceiver returns a UDP socket receiving notifications
+func listenReceiver(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn
+}
+
+func receiveNotification(t *testing.T, conn net.PacketConn) (*snmpMessage, net.Addr) {
+	t.Helper()
+
+	buf := make([]byte, 65535)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := unmarshalMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg, addr
+}
+
+func TestSendTrap(t *testing.T) {
+	conn := listenReceiver(t)
+
+	pp := NewPassPersist(
+		WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+		WithTrapReceiver(conn.LocalAddr().String(), "public"),
+	)
+
+	trapOID := MustNewOID("1.3.6.1.4.1.8072.9.1")
+	vb := &VarBind{
+		OID:       MustNewOID("1.3.6.1.4.1.8072.1.0"),
+		ValueType: "string",
+		Value:     typedValue{&StringVal{"down"}},
+	}
+	if err := pp.SendTrap(trapOID, vb); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, _ := receiveNotification(t, conn)
+	if msg.version != snmpV2c || msg.community != "public" || msg.pdu.tag != pduTrapV2 {
+		t.Fatalf("unexpected message version %d community %s pdu 0x%02x", msg.version, msg.community, msg.pdu.tag)
+	}
+
+	vbs := msg.pdu.varBinds
+	if len(vbs) != 3 {
+		t.Fatalf("got %d variables, want 3", len(vbs))
+	}
+	if !vbs[0].oid.Equal(sysUpTimeOID) || vbs[0].tag != tagTimeTicks {
+		t.Errorf("first variable is %s, want sysUpTime.0", vbs[0].oid.String())
+	}
+	if !vbs[1].oid.Equal(snmpTrapOIDOID) || !vbs[1].value.GetOIDVal().Equal(trapOID) {
+		t.Errorf("second variable is %s = %v, want snmpTrapOID.0 = %s", vbs[1].oid.String(), vbs[1].value.String(), trapOID.String())
+	}
+	if !vbs[2].oid.Equal(vb.OID) || string(vbs[2].value.GetOctetStringVal()) != "down" {
+		t.Errorf("unexpected variable %s = %v", vbs[2].oid.String(), vbs[2].value.String())
+	}
+}
+
+func TestSendInform(t *testing.T) {
+	conn := listenReceiver(t)
+
+	pp := NewPassPersist(
+		WithInformReceiver(conn.LocalAddr().String(), "public", 100*time.Millisecond, 1),
+	)
+
+	// acknowledge the retry only
+	go func() {
+		buf := make([]byte, 65535)
+		for i := 0; i < 2; i++ {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg, err := unmarshalMessage(buf[:n])
+			if i == 0 || err != nil || msg.pdu.tag != pduInformRequest {
+				continue
+			}
+			msg.pdu.tag = pduResponse
+			conn.WriteTo(msg.marshal(), addr)
+		}
+	}()
+
+	if err := pp.SendTrap(MustNewOID("1.3.6.1.4.1.8072.9.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := pp.SendTrapContext(ctx, MustNewOID("1.3.6.1.4.1.8072.9.1")); err == nil {
+		t.Error("unacknowledged inform succeeded")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("inform took %s after the context was done", d)
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/netip"
 	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -16,10 +20,19 @@ type SetError int
 
 const (
 	NotWriteable SetError = iota
-	// WrongType
-	// WrongValue
-	// WrongLength
-	// InconsistentValue
+	WrongType
+	WrongValue
+	WrongLength
+	InconsistentValue
+	NoAccess
+	WrongEncoding
+	NoCreation
+	ResourceUnavailable
+	CommitFailed
+	UndoFailed
+	AuthorizationError
+	InconsistentName
+	GenError
 )
 
 const (
@@ -30,6 +43,7 @@ const (
 var (
 	DefaultBaseOID     = MustNewOID(NetSnmpExtendMib).MustAppend([]int{226})
 	DefaultRefreshRate = time.Second * 60
+	DefaultMaxAgeWait  = time.Second
 )
 
 func init() {
@@ -44,46 +58,190 @@ func (e SetError) String() string {
 	switch e {
 	case NotWriteable:
 		return "not-writable"
-	// case WrongType:
-	// 	return "wrong-type"
-	// case WrongValue:
-	// 	return "wrong-value"
-	// case WrongLength:
-	// 	return "wrong-length"
-	// case InconsistentValue:
-	// 	return "inconsistent-value"
+	case WrongType:
+		return "wrong-type"
+	case WrongValue:
+		return "wrong-value"
+	case WrongLength:
+		return "wrong-length"
+	case InconsistentValue:
+		return "inconsistent-value"
+	case NoAccess:
+		return "no-access"
+	case WrongEncoding:
+		return "wrong-encoding"
+	case NoCreation:
+		return "no-creation"
+	case ResourceUnavailable:
+		return "resource-unavailable"
+	case CommitFailed:
+		return "commit-failed"
+	case UndoFailed:
+		return "undo-failed"
+	case AuthorizationError:
+		return "authorization-error"
+	case InconsistentName:
+		return "inconsistent-name"
+	case GenError:
 	default:
-		slog.Warn("unknown value type id", slog.Any("error", e))
+		// never answer an unknown error with a token snmpd could ignore
+		slog.Warn("unknown set error", slog.Int("error", int(e)))
 	}
-	return "unknown-error"
+	return "gen-error"
+}
+
+func (e SetError) Error() string {
+	return e.String()
+}
+
+// SetHandler is called with the parsed value of a set request. Returning a
+// SetError answers snmpd with that error, any other error is reported as
+// commit-failed.
+type SetHandler func(*VarBind) error
+
+type setHandler struct {
+	oid         OID
+	fn          SetHandler
+	constraints []Constraint
 }
 
 type Option func(*PassPersist)
 
+var errNotIncremental = errors.New("deleting entries requires incremental mode")
+
 func WithRefresh(d time.Duration) func(*PassPersist) {
 	return func(p *PassPersist) {
 		p.refreshRate = d
 	}
 }
 
+// WithUpdateTimeout sets the deadline of the context passed to update
+// callbacks. Updates running longer are abandoned and the committed entries
+// are kept. Zero disables the timeout.
+func WithUpdateTimeout(d time.Duration) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.updateTimeout = d
+	}
+}
+
+// WithMaxAge refreshes the collectors before answering a get or getnext
+// when they were last updated more than d ago. Zero disables the check.
+func WithMaxAge(d time.Duration) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.maxAge = d
+	}
+}
+
+// WithMaxAgeWait bounds how long a request waits for the refresh triggered
+// by WithMaxAge, defaults to DefaultMaxAgeWait. The request is then answered
+// from the committed entries and the refresh completes in the background.
+func WithMaxAgeWait(d time.Duration) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.maxAgeWait = d
+	}
+}
+
+// WithRefreshSignals sets the signals triggering a refresh of all
+// collectors, defaults to SIGHUP. No signals disables signal handling.
+func WithRefreshSignals(sigs ...os.Signal) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.refreshSignals = sigs
+	}
+}
+
+// WithIncremental keeps the entries of previous updates, callbacks only add
+// or replace the entries that changed and remove stale ones with Delete and
+// DeleteSubtree
+func WithIncremental() func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.incremental = true
+	}
+}
+
 func WithBaseOID(o OID) func(*PassPersist) {
 	return func(p *PassPersist) {
 		p.baseOID = o
 	}
 }
 
+// WithInput sets the reader requests are read from, defaults to os.Stdin
+func WithInput(r io.Reader) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.in = r
+	}
+}
+
+// WithArgs sets the command line arguments checked for a one-shot pass
+// request, defaults to os.Args[1:]
+func WithArgs(args []string) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.args = args
+	}
+}
+
+// WithOutput sets the writer responses are written to, defaults to os.Stdout
+func WithOutput(w io.Writer) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.out = w
+	}
+}
+
+// Stats counts the cache updates
+type Stats struct {
+	Updates      uint64    `json:"updates"`
+	UpdateErrors uint64    `json:"update-errors"`
+	LastUpdate   time.Time `json:"last-update"`
+	LastError    string    `json:"last-error,omitempty"`
+}
+
 type PassPersist struct {
-	cache       *Cache
-	baseOID     OID
-	refreshRate time.Duration
+	// root is the PassPersist a view was created from
+	root           *PassPersist
+	cache          *Cache
+	baseOID        OID
+	refreshRate    time.Duration
+	updateTimeout  time.Duration
+	setHandlers    []setHandler
+	collectors     []*collector
+	maxAge         time.Duration
+	maxAgeWait     time.Duration
+	refreshSignals []os.Signal
+	runMu          sync.Mutex
+	running        []*collector
+	in             io.Reader
+	out            io.Writer
+	args           []string
+	agentxNetwork  string
+	agentxAddress  string
+	notify         *notifier
+	rules          rules
+	incremental    bool
+	persistPath    string
+	persistDelay   time.Duration
+	persistMu      sync.Mutex
+	persistTimer   *time.Timer
+	saveMu         sync.Mutex
+	persisted      uint64
+	ttls           []*ttl
+	// tx is the transaction of a view
+	tx      *Tx
+	statsMu sync.Mutex
+	stats   Stats
 }
 
 func NewPassPersist(opts ...Option) *PassPersist {
 
 	p := &PassPersist{
-		cache:       NewCache(),
-		baseOID:     DefaultBaseOID,
-		refreshRate: DefaultRefreshRate,
+		cache:          NewCache(),
+		baseOID:        DefaultBaseOID,
+		refreshRate:    DefaultRefreshRate,
+		maxAgeWait:     DefaultMaxAgeWait,
+		persistDelay:   defaultPersistDelay,
+		in:             os.Stdin,
+		out:            os.Stdout,
+		args:           os.Args[1:],
+		refreshSignals: []os.Signal{syscall.SIGHUP},
+		notify:         newNotifier(),
 	}
 
 	for _, fn := range opts {
@@ -103,15 +261,52 @@ func (p *PassPersist) AddEntry(subs []int, value typedValue) error {
 
 	slog.Debug("adding entry", slog.Any("value", value))
 
-	p.cache.Set(&VarBind{
+	vb := &VarBind{
 		OID:       oid,
 		ValueType: value.TypeString(),
 		Value:     value,
-	})
+	}
+	if p.incremental {
+		p.cache.Upsert(vb)
+	} else {
+		p.cache.Set(vb)
+	}
 
 	return nil
 }
 
+// Delete removes the entry at subs when the update succeeds, in incremental
+// mode
+func (p *PassPersist) Delete(subs []int) error {
+	if !p.incremental {
+		return errNotIncremental
+	}
+
+	oid, err := p.baseOID.Append(subs)
+	if err != nil {
+		return err
+	}
+
+	p.cache.Delete(oid)
+	return nil
+}
+
+// DeleteSubtree removes the entries at and below subs when the update
+// succeeds, in incremental mode
+func (p *PassPersist) DeleteSubtree(subs []int) error {
+	if !p.incremental {
+		return errNotIncremental
+	}
+
+	oid, err := p.baseOID.Append(subs)
+	if err != nil {
+		return err
+	}
+
+	p.cache.DeleteSubtree(oid)
+	return nil
+}
+
 func (p *PassPersist) AddString(subIds []int, value string) error {
 	return p.AddEntry(subIds, typedValue{&StringVal{value}})
 }
@@ -208,33 +403,109 @@ func (p *PassPersist) MustAddTimeTicks(subIds []int, value time.Duration) {
 	}
 }
 
+// OnSet registers a handler for set requests on the OID at subs or anywhere
+// below it. When several handlers match, the most specific one is used.
+// Values failing any of the constraints are rejected before the handler is
+// called.
+func (p *PassPersist) OnSet(subs []int, fn SetHandler, constraints ...Constraint) error {
+	oid, err := p.baseOID.Append(subs)
+	if err != nil {
+		return err
+	}
+
+	p = p.owner()
+	p.setHandlers = append(p.setHandlers, setHandler{
+		oid:         oid,
+		fn:          fn,
+		constraints: constraints,
+	})
+	return nil
+}
+
+func (p *PassPersist) MustOnSet(subs []int, fn SetHandler, constraints ...Constraint) {
+	err := p.OnSet(subs, fn, constraints...)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Cache returns the cache entries are committed to
+func (p *PassPersist) Cache() *Cache {
+	return p.owner().cache
+}
+
+// Start runs f, if not nil, and the collectors in the background until ctx
+// is done without serving the pass_persist protocol, e.g. to populate the
+// cache served by an Agent.
+func (p *PassPersist) Start(ctx context.Context, f func(context.Context, *PassPersist) error) {
+	p.start(ctx, p.collectorsWith(f))
+}
+
+// Run serves the pass_persist protocol until the input is closed or ctx is
+// done, refreshing the cache with f. When the program was invoked by snmpd's
+// pass directive (-g, -n or -s arguments) f is called once, the single
+// request is answered and Run returns. With WithAgentX requests of the
+// AgentX master are answered instead until ctx is done.
 func (p *PassPersist) Run(ctx context.Context, f func(*PassPersist)) {
-	input := make(chan string)
-	done := make(chan bool)
+	p.RunE(ctx, func(p *PassPersist) error {
+		f(p)
+		return nil
+	})
+}
+
+// RunE is like Run but f may fail. When f returns an error the entries it
+// added are discarded and the previously committed entries are served until
+// the next successful update.
+func (p *PassPersist) RunE(ctx context.Context, f func(*PassPersist) error) {
+	p.RunContext(ctx, func(_ context.Context, p *PassPersist) error {
+		return f(p)
+	})
+}
 
-	go p.update(ctx, f)
-	go watchStdin(ctx, input, done)
+// RunContext is like RunE but f receives a context which is done when the
+// update timeout expires. Panics in f are recovered and handled like errors.
+func (p *PassPersist) RunContext(ctx context.Context, f func(context.Context, *PassPersist) error) {
+	collectors := p.collectorsWith(f)
+
+	if cmd, oid, val, ok := parsePassArgs(p.args); ok {
+		p.runOnce(ctx, collectors, cmd, oid, val)
+		return
+	}
+
+	p.start(ctx, collectors)
+
+	if p.agentxAddress != "" {
+		p.serveAgentX(ctx)
+		return
+	}
+
+	input := make(chan string)
+	go watchInput(ctx, p.in, input)
 
 	for {
 		select {
-		case line := <-input:
+		case line, ok := <-input:
+			if !ok {
+				return
+			}
 			switch line {
 			case "PING":
-				fmt.Println("PONG")
+				fmt.Fprintln(p.out, "PONG")
 			case "getnext":
 				inp := <-input
 				slog.Debug("validating", "input", inp)
 				oid, err := convertAndValidateOID(inp, p.baseOID)
 				if err != nil {
 					slog.Warn("failed to validate input", "input", slog.Any("error", err))
-					fmt.Println("NONE")
+					fmt.Fprintln(p.out, "NONE")
 				} else {
 					slog.Debug("getNext", "oid", oid.String())
+					p.ensureFresh(ctx)
 					v := p.getNext(oid)
 					if v != nil {
-						fmt.Println(v.Marshal())
+						fmt.Fprintln(p.out, v.Marshal())
 					} else {
-						fmt.Println("NONE")
+						fmt.Fprintln(p.out, "NONE")
 					}
 				}
 
@@ -243,46 +514,144 @@ func (p *PassPersist) Run(ctx context.Context, f func(*PassPersist)) {
 				oid, err := convertAndValidateOID(inp, p.baseOID)
 				if err != nil {
 					slog.Warn("failed to validate input", "input", slog.Any("error", err))
-					fmt.Println("NONE")
+					fmt.Fprintln(p.out, "NONE")
 				} else {
 					slog.Debug("get", "oid", oid.String())
+					p.ensureFresh(ctx)
 					v := p.get(oid)
 					if v != nil {
-						fmt.Println(v.Marshal())
+						fmt.Fprintln(p.out, v.Marshal())
 					} else {
-						fmt.Println("NONE")
+						fmt.Fprintln(p.out, "NONE")
 					}
 				}
 			case "set":
-				fmt.Println(NotWriteable.String())
+				inp := <-input
+				val := <-input
+				fmt.Fprintln(p.out, p.set(inp, val))
 			case "DUMP", "C":
-				p.cache.Dump()
+				p.cache.Dump(p.out)
 			case "DUMPINDEX", "I":
-				p.cache.DumpIndex()
+				p.cache.DumpIndex(p.out)
 			case "DUMPCONFIG", "O":
 				p.dumpConfig()
+			case "DUMPSTATS", "S":
+				p.dumpStats()
 			case "PANIC":
 				_ = make([]any, 0)[1]
 			default:
-				fmt.Println("NONE")
+				fmt.Fprintln(p.out, "NONE")
 			}
-		case <-done:
-			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// runOnce answers a single pass request. Unlike pass_persist nothing is
+// printed for a missing OID or a successful set.
+func (p *PassPersist) runOnce(ctx context.Context, collectors []*collector, cmd string, inp string, val string) {
+	for _, c := range collectors {
+		p.refresh(ctx, c)
+	}
+
+	switch cmd {
+	case "-g", "-n":
+		oid, err := convertAndValidateOID(inp, p.baseOID)
+		if err != nil {
+			slog.Warn("failed to validate input", "input", slog.Any("error", err))
+			return
+		}
+
+		var v *VarBind
+		if cmd == "-g" {
+			v = p.get(oid)
+		} else {
+			v = p.getNext(oid)
+		}
+		if v != nil {
+			fmt.Fprintln(p.out, v.Marshal())
+		}
+	case "-s":
+		if r := p.set(inp, val); r != "DONE" {
+			fmt.Fprintln(p.out, r)
+		}
+	}
+}
+
 func (p *PassPersist) dumpConfig() {
+	collectors := make([]map[string]any, 0, len(p.collectors))
+	for _, c := range p.collectors {
+		collectors = append(collectors, map[string]any{
+			"oid":      c.oid,
+			"interval": c.interval,
+		})
+	}
+
+	ttls := make([]map[string]any, 0, len(p.ttls))
+	for _, t := range p.ttls {
+		ttls = append(ttls, map[string]any{
+			"oid":          t.oid,
+			"ttl":          t.duration,
+			"stale-column": t.column,
+		})
+	}
+
+	receivers := make([]map[string]any, 0, len(p.notify.receivers))
+	for _, r := range p.notify.receivers {
+		receivers = append(receivers, map[string]any{
+			"address": r.addr,
+			"inform":  r.inform,
+		})
+	}
+
 	b, err := json.MarshalIndent(map[string]any{
-		"base-oid":     p.baseOID,
-		"refresh-rate": p.refreshRate,
+		"base-oid":       p.baseOID,
+		"refresh-rate":   p.refreshRate,
+		"update-timeout": p.updateTimeout,
+		"max-age":        p.maxAge,
+		"max-age-wait":   p.maxAgeWait,
+		"incremental":    p.incremental,
+		"cache-file":     p.persistPath,
+		"collectors":     collectors,
+		"receivers":      receivers,
+		"ttls":           ttls,
 	}, "", "   ")
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Fprintln(p.out, err.Error())
 	}
-	fmt.Println(string(b))
+	fmt.Fprintln(p.out, string(b))
+}
+
+func (p *PassPersist) dumpStats() {
+	b, err := json.MarshalIndent(p.Stats(), "", "   ")
+	if err != nil {
+		fmt.Fprintln(p.out, err.Error())
+	}
+	fmt.Fprintln(p.out, string(b))
+}
+
+// Stats returns a copy of the update counters
+func (p *PassPersist) Stats() Stats {
+	p = p.owner()
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	return p.stats
+}
+
+func (p *PassPersist) recordUpdate(err error) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	p.stats.Updates++
+	if err != nil {
+		p.stats.UpdateErrors++
+		p.stats.LastError = err.Error()
+		return
+	}
+	p.stats.LastUpdate = time.Now()
+	p.stats.LastError = ""
 }
 
 func (p *PassPersist) overrideFromEnv() {
@@ -299,21 +668,23 @@ func (p *PassPersist) overrideFromEnv() {
 			p.refreshRate = r
 		}
 	}
-}
-
-func (p *PassPersist) update(ctx context.Context, callback func(*PassPersist)) {
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			timer := time.NewTimer(p.refreshRate)
+	if val, ok := os.LookupEnv("PASSPERSIST_MAX_AGE"); ok {
+		if r, err := time.ParseDuration(val); err == nil {
+			slog.Info("overriding max age from env", "was", p.maxAge, "now", r)
+			p.maxAge = r
+		}
+	}
 
-			callback(p)
-			p.cache.Commit()
+	if val, ok := os.LookupEnv("PASSPERSIST_CACHE_FILE"); ok {
+		slog.Info("overriding cache file from env", "was", p.persistPath, "now", val)
+		p.persistPath = val
+	}
 
-			<-timer.C
+	if val, ok := os.LookupEnv("PASSPERSIST_UPDATE_TIMEOUT"); ok {
+		if r, err := time.ParseDuration(val); err == nil {
+			slog.Info("overriding update timeout from env", "was", p.updateTimeout, "now", r)
+			p.updateTimeout = r
 		}
 	}
 }
@@ -327,32 +698,120 @@ func (p *PassPersist) getNext(oid OID) *VarBind {
 	return p.cache.GetNext(oid)
 }
 
-func watchStdin(ctx context.Context, input chan<- string, done chan<- bool) {
+// set handles a set request and returns the response line for snmpd
+func (p *PassPersist) set(inp string, val string) string {
+	oid, err := convertAndValidateOID(inp, p.baseOID)
+	if err != nil {
+		slog.Warn("failed to validate input", "input", slog.Any("error", err))
+		return NotWriteable.String()
+	}
+
+	h := p.findSetHandler(oid)
+	if h == nil {
+		slog.Debug("no set handler", "oid", oid.String())
+		return NotWriteable.String()
+	}
+
+	tv, err := parseTypedValue(val)
+	if err != nil {
+		slog.Warn("failed to parse set value", "oid", oid.String(), slog.Any("error", err))
+		return setErrorOf(err, WrongValue).String()
+	}
 
-	scanner := bufio.NewScanner(os.Stdin)
+	vb := &VarBind{
+		OID:       oid,
+		ValueType: tv.TypeString(),
+		Value:     tv,
+	}
 
-	defer func() {
-		done <- true
-	}()
+	if err := h.check(vb); err != nil {
+		slog.Debug("set value rejected", "oid", oid.String(), slog.Any("error", err))
+		return setErrorOf(err, GenError).String()
+	}
+
+	slog.Debug("set", "oid", oid.String(), "value", tv.String())
+	if err := h.fn(vb); err != nil {
+		slog.Warn("set handler failed", "oid", oid.String(), slog.Any("error", err))
+		return setErrorOf(err, CommitFailed).String()
+	}
+
+	return "DONE"
+}
+
+// check returns the error of the first constraint rejecting vb
+func (h *setHandler) check(vb *VarBind) error {
+	for _, c := range h.constraints {
+		if err := c(vb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setErrorOf returns the SetError wrapped by err or def
+func setErrorOf(err error, def SetError) SetError {
+	var se SetError
+	if errors.As(err, &se) {
+		return se
+	}
+	return def
+}
+
+func (p *PassPersist) findSetHandler(oid OID) *setHandler {
+	var found *setHandler
+	for i, h := range p.setHandlers {
+		if !oid.StartsWith(h.oid) {
+			continue
+		}
+		if found == nil || len(h.oid.Value) > len(found.oid.Value) {
+			found = &p.setHandlers[i]
+		}
+	}
+	return found
+}
+
+// watchInput sends each line read from r to input and closes input when r
+// is exhausted
+func watchInput(ctx context.Context, r io.Reader, input chan<- string) {
+
+	scanner := bufio.NewScanner(r)
+
+	defer close(input)
 
 	for scanner.Scan() {
+		line := scanner.Text()
+		slog.Debug("got user input", "input", line)
 
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			line := scanner.Text()
-			slog.Debug("got user input", "input", line)
-			input <- line
+		case input <- line:
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		if err != io.EOF {
-			slog.Error("scanner encountered an error", slog.Any("error", err.Error()))
-			os.Exit(1)
+		slog.Error("scanner encountered an error", slog.Any("error", err.Error()))
+	}
+}
+
+// parsePassArgs returns the request passed on the command line by snmpd's
+// pass directive: '-g OID', '-n OID' or '-s OID TYPE VALUE'
+func parsePassArgs(args []string) (cmd string, oid string, val string, ok bool) {
+	if len(args) < 2 {
+		return "", "", "", false
+	}
+
+	switch args[0] {
+	case "-g", "-n":
+		return args[0], args[1], "", len(args) == 2
+	case "-s":
+		if len(args) < 3 {
+			return "", "", "", false
 		}
+		return args[0], args[1], strings.Join(args[2:], " "), true
 	}
+
+	return "", "", "", false
 }
 
 func convertAndValidateOID(oid string, baseOID OID) (OID, error) {
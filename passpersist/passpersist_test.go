@@ -1,6 +1,13 @@
 package passpersist
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestConvertAndValidateOID(t *testing.T) {
 	_, err := convertAndValidateOID("1.3.6.1.4.1.8072.1", MustNewOID("1.3.6.1.4.1.8072"))
@@ -16,3 +23,303 @@ func TestWithBaseOID(t *testing.T) {
 		t.Errorf("expected base OID to be %s, got %s", base, pp.baseOID)
 	}
 }
+
+func TestSet(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	var got *VarBind
+	pp.MustOnSet([]int{1}, func(vb *VarBind) error {
+		got = vb
+		return nil
+	})
+	pp.MustOnSet([]int{1, 2}, func(vb *VarBind) error {
+		return NotWriteable
+	})
+	pp.MustOnSet([]int{1, 3}, func(vb *VarBind) error {
+		return errors.New("device busy")
+	})
+
+	if r := pp.set("1.3.6.1.4.1.8072.1.1", "integer 42"); r != "DONE" {
+		t.Errorf("expected DONE, got %s", r)
+	}
+	if got == nil || got.Value.GetIntVal() != 42 {
+		t.Errorf("expected handler to receive 42, got %v", got)
+	}
+
+	if r := pp.set("1.3.6.1.4.1.8072.1.2.1", "string \"hello\""); r != "not-writable" {
+		t.Errorf("expected not-writable from most specific handler, got %s", r)
+	}
+
+	if r := pp.set("1.3.6.1.4.1.8072.1.3", "integer 1"); r != "commit-failed" {
+		t.Errorf("expected commit-failed from a plain handler error, got %s", r)
+	}
+
+	if r := pp.set("1.3.6.1.4.1.8072.2", "integer 1"); r != "not-writable" {
+		t.Errorf("expected not-writable without handler, got %s", r)
+	}
+}
+
+func TestParseTypedValue(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"integer -5", "-5"},
+		{"string \"hello world\"", "hello world"},
+		{"octet \"68 69\"", "hi"},
+		{"gauge 7", "7"},
+		{"counter 9", "9"},
+		{"ipaddress 10.0.0.1", "10.0.0.1"},
+		{"objectid \".1.3.6.1\"", "1.3.6.1"},
+	}
+
+	for _, tt := range tests {
+		tv, err := parseTypedValue(tt.line)
+		if err != nil {
+			t.Errorf("failed to parse '%s': %s", tt.line, err)
+			continue
+		}
+		if tv.String() != tt.want {
+			t.Errorf("expected '%s', got '%s'", tt.want, tv.String())
+		}
+	}
+
+	if _, err := parseTypedValue("bogus 1"); err == nil {
+		t.Errorf("expected error for unknown type")
+	}
+}
+
+func TestRunWithBuffers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := strings.NewReader(strings.Join([]string{
+		"PING",
+		"get",
+		"1.3.6.1.4.1.8072.1",
+		"getnext",
+		"1.3.6.1.4.1.8072.1",
+		"getnext",
+		"1.3.6.1.4.1.8072.2",
+		"set",
+		"1.3.6.1.4.1.8072.1",
+		"string \"x\"",
+	}, "\n"))
+	out := &bytes.Buffer{}
+
+	pp := NewPassPersist(
+		WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+		WithInput(in),
+		WithOutput(out),
+	)
+
+	update := func(pp *PassPersist) {
+		pp.MustAddString([]int{1}, "one")
+		pp.MustAddInt([]int{2}, 2)
+	}
+	update(pp)
+	pp.cache.Commit()
+
+	pp.Run(ctx, update)
+
+	want := strings.Join([]string{
+		"PONG",
+		"1.3.6.1.4.1.8072.1", "STRING", "one",
+		"1.3.6.1.4.1.8072.2", "INTEGER", "2",
+		"NONE",
+		"not-writable",
+	}, "\n") + "\n"
+
+	if out.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-g", "1.3.6.1.4.1.8072.1"}, "1.3.6.1.4.1.8072.1\nSTRING\none\n"},
+		{[]string{"-n", "1.3.6.1.4.1.8072.1"}, "1.3.6.1.4.1.8072.2\nINTEGER\n2\n"},
+		{[]string{"-n", "1.3.6.1.4.1.8072.2"}, ""},
+		{[]string{"-s", "1.3.6.1.4.1.8072.2", "integer", "5"}, ""},
+		{[]string{"-s", "1.3.6.1.4.1.8072.1", "string", "hello world"}, "not-writable\n"},
+	}
+
+	for _, tt := range tests {
+		out := &bytes.Buffer{}
+		pp := NewPassPersist(
+			WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+			WithArgs(tt.args),
+			WithInput(strings.NewReader("PING\n")),
+			WithOutput(out),
+		)
+		pp.MustOnSet([]int{2}, func(vb *VarBind) error { return nil })
+
+		pp.Run(context.Background(), func(pp *PassPersist) {
+			pp.MustAddString([]int{1}, "one")
+			pp.MustAddInt([]int{2}, 2)
+		})
+
+		if out.String() != tt.want {
+			t.Errorf("%v: expected %q, got %q", tt.args, tt.want, out.String())
+		}
+	}
+}
+
+func refreshBase(ctx context.Context, pp *PassPersist, f func(context.Context, *PassPersist) error) {
+	pp.refresh(ctx, pp.collectorsWith(f)[0])
+}
+
+func TestRefreshOuterHandle(t *testing.T) {
+	for _, incremental := range []bool{false, true} {
+		opts := []Option{WithBaseOID(MustNewOID("1.3.6.1.4.1.8072"))}
+		if incremental {
+			opts = append(opts, WithIncremental())
+		}
+		pp := NewPassPersist(opts...)
+
+		refreshBase(context.Background(), pp, func(_ context.Context, v *PassPersist) error {
+			// entries added through the captured handle are committed too
+			pp.MustAddString([]int{1}, "outer")
+			v.MustAddString([]int{2}, "inner")
+			if v.Cache() != pp.Cache() {
+				t.Error("view has a cache of its own")
+			}
+			return nil
+		})
+
+		for o, want := range map[string]string{"1.3.6.1.4.1.8072.1": "outer", "1.3.6.1.4.1.8072.2": "inner"} {
+			if v := pp.get(MustNewOID(o)); v == nil || v.Value.String() != want {
+				t.Errorf("incremental %v: %s: got %v, want '%s'", incremental, o, v, want)
+			}
+		}
+		if pp.Stats().Updates != 1 {
+			t.Errorf("incremental %v: got %d updates, want 1", incremental, pp.Stats().Updates)
+		}
+	}
+}
+
+func TestRefreshKeepsLastGood(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+	oid := MustNewOID("1.3.6.1.4.1.8072.1")
+	ctx := context.Background()
+
+	refreshBase(ctx, pp, func(_ context.Context, pp *PassPersist) error {
+		pp.MustAddString([]int{1}, "good")
+		return nil
+	})
+
+	refreshBase(ctx, pp, func(_ context.Context, pp *PassPersist) error {
+		pp.MustAddString([]int{1}, "bad")
+		return errors.New("collector failed")
+	})
+
+	if v := pp.get(oid); v == nil || v.Value.GetStringVal() != "good" {
+		t.Errorf("expected last good value to be served, got %v", v)
+	}
+
+	refreshBase(ctx, pp, func(_ context.Context, pp *PassPersist) error {
+		return nil
+	})
+
+	if v := pp.get(oid); v != nil {
+		t.Errorf("expected failed update to be discarded, got %v", v)
+	}
+
+	s := pp.Stats()
+	if s.Updates != 3 || s.UpdateErrors != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestRefreshRecoversPanic(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+		pp.MustAddString([]int{1}, "partial")
+		panic("collector bug")
+	})
+
+	if v := pp.get(MustNewOID("1.3.6.1.4.1.8072.1")); v != nil {
+		t.Errorf("expected entries of panicked update to be discarded, got %v", v)
+	}
+	if s := pp.Stats(); s.UpdateErrors != 1 {
+		t.Errorf("expected panic to be counted as an error: %+v", s)
+	}
+}
+
+func TestRefreshTimeout(t *testing.T) {
+	pp := NewPassPersist(
+		WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+		WithUpdateTimeout(10*time.Millisecond),
+	)
+
+	block := make(chan struct{})
+	defer close(block)
+
+	start := time.Now()
+	refreshBase(context.Background(), pp, func(ctx context.Context, pp *PassPersist) error {
+		<-block
+		return nil
+	})
+
+	if time.Since(start) > time.Second {
+		t.Errorf("expected hung update to be abandoned")
+	}
+	if s := pp.Stats(); s.UpdateErrors != 1 {
+		t.Errorf("expected timeout to be counted as an error: %+v", s)
+	}
+}
+
+func TestRefreshTimeoutDropsLateWrites(t *testing.T) {
+	pp := NewPassPersist(
+		WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+		WithUpdateTimeout(10*time.Millisecond),
+	)
+	ctx := context.Background()
+
+	// the abandoned callback keeps writing after its deadline
+	late := make(chan struct{})
+	refreshBase(ctx, pp, func(ctx context.Context, pp *PassPersist) error {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		pp.MustAddString([]int{1}, "late")
+		close(late)
+		return nil
+	})
+	<-late
+
+	refreshBase(ctx, pp, func(_ context.Context, pp *PassPersist) error {
+		pp.MustAddString([]int{2}, "next")
+		return nil
+	})
+
+	if pp.get(MustNewOID("1.3.6.1.4.1.8072.1")) != nil {
+		t.Error("entry of an abandoned update was committed")
+	}
+	if pp.get(MustNewOID("1.3.6.1.4.1.8072.2")) == nil {
+		t.Error("entry of the next update is missing")
+	}
+}
+
+func TestSetErrorString(t *testing.T) {
+	want := []string{
+		"not-writable", "wrong-type", "wrong-value", "wrong-length",
+		"inconsistent-value", "no-access", "wrong-encoding", "no-creation",
+		"resource-unavailable", "commit-failed", "undo-failed",
+		"authorization-error", "inconsistent-name", "gen-error",
+	}
+	for i, w := range want {
+		if got := SetError(i).String(); got != w {
+			t.Errorf("%d: got '%s', want '%s'", i, got, w)
+		}
+	}
+	if got := SetError(99).String(); got != "gen-error" {
+		t.Errorf("unknown set error: got '%s', want 'gen-error'", got)
+	}
+	if SetError(99).errorStatus() != errGenErr || NotWriteable.errorStatus() != errNotWritable {
+		t.Error("unexpected error status")
+	}
+}
@@ -0,0 +1,303 @@
+package passpersist
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// persistVersion is the version of the cache file format
+const persistVersion = 1
+
+// defaultPersistDelay is how long commits are coalesced before the cache
+// file is saved
+const defaultPersistDelay = time.Second
+
+type persistedCache struct {
+	Version int              `json:"version"`
+	Time    time.Time        `json:"time"`
+	Entries []persistedEntry `json:"entries"`
+}
+
+// persistedEntry is a value tagged with its kind so that it is decoded to
+// the same typed value
+type persistedEntry struct {
+	OID   string `json:"oid"`
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// WithPersistence saves the committed entries to path in the background,
+// at most once a second, and loads them at startup, marked stale, so that
+// requests are answered until the first update of their subtree completes.
+// In incremental mode the loaded entries are kept until they are replaced or
+// deleted.
+func WithPersistence(path string) func(*PassPersist) {
+	return func(p *PassPersist) {
+		p.persistPath = path
+	}
+}
+
+func encodePersisted(v *typedValue) (string, string, error) {
+	switch x := v.GetValue().(type) {
+	case *StringVal:
+		return "string", x.Value, nil
+	case *OctetStringVal:
+		return "octets", hex.EncodeToString(x.Value), nil
+	case *IntVal:
+		return "int", strconv.FormatInt(int64(x.Value), 10), nil
+	case *Counter32Val:
+		return "counter32", strconv.FormatUint(uint64(x.Value), 10), nil
+	case *Counter64Val:
+		return "counter64", strconv.FormatUint(x.Value, 10), nil
+	case *GaugeVal:
+		return "gauge", strconv.FormatUint(uint64(x.Value), 10), nil
+	case *IPAddrVal:
+		return "ipaddress", x.Value.String(), nil
+	case *IPV6AddrVal:
+		return "ipv6address", x.Value.String(), nil
+	case *OIDVal:
+		return "oid", x.Value.String(), nil
+	case *TimeTicksVal:
+		return "timeticks", strconv.FormatInt(int64(x.Value), 10), nil
+	}
+	return "", "", fmt.Errorf("unsupported value type %T", v.GetValue())
+}
+
+func decodePersisted(kind string, value string) (typedValue, error) {
+	switch kind {
+	case "string":
+		return typedValue{&StringVal{value}}, nil
+	case "octets":
+		b, err := hex.DecodeString(value)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&OctetStringVal{b}}, nil
+	case "int":
+		i, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&IntVal{int32(i)}}, nil
+	case "counter32", "gauge":
+		i, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return typedValue{}, err
+		}
+		if kind == "gauge" {
+			return typedValue{&GaugeVal{uint32(i)}}, nil
+		}
+		return typedValue{&Counter32Val{uint32(i)}}, nil
+	case "counter64":
+		i, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&Counter64Val{i}}, nil
+	case "ipaddress", "ipv6address":
+		a, err := netip.ParseAddr(value)
+		if err != nil {
+			return typedValue{}, err
+		}
+		if kind == "ipv6address" {
+			return typedValue{&IPV6AddrVal{a}}, nil
+		}
+		return typedValue{&IPAddrVal{a}}, nil
+	case "oid":
+		o, err := NewOID(value)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&OIDVal{o}}, nil
+	case "timeticks":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&TimeTicksVal{time.Duration(d)}}, nil
+	}
+	return typedValue{}, fmt.Errorf("unknown value kind '%s'", kind)
+}
+
+// Save writes the committed entries to w
+func (c *Cache) Save(w io.Writer) error {
+	return c.Snapshot().Save(w)
+}
+
+// SaveFile atomically replaces path with the committed entries
+func (c *Cache) SaveFile(path string) error {
+	return c.Snapshot().SaveFile(path)
+}
+
+// Save writes the entries to w
+func (s *Snapshot) Save(w io.Writer) error {
+	pc := persistedCache{
+		Version: persistVersion,
+		Time:    s.time,
+		Entries: make([]persistedEntry, 0, len(s.index)),
+	}
+	for _, vb := range s.index {
+		kind, value, err := encodePersisted(&vb.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", vb.OID.String(), err)
+		}
+		pc.Entries = append(pc.Entries, persistedEntry{vb.OID.String(), kind, value})
+	}
+
+	return json.NewEncoder(w).Encode(pc)
+}
+
+// SaveFile atomically replaces path with the entries
+func (s *Snapshot) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := s.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Load replaces the committed entries with the entries saved to r, they are
+// stale until replaced and the resulting snapshot has the time of the save
+func (c *Cache) Load(r io.Reader) error {
+	var pc persistedCache
+	if err := json.NewDecoder(r).Decode(&pc); err != nil {
+		return err
+	}
+	if pc.Version != persistVersion {
+		return fmt.Errorf("unsupported cache file version %d", pc.Version)
+	}
+
+	entries := make(map[string]*VarBind, len(pc.Entries))
+	for _, e := range pc.Entries {
+		oid, err := NewOID(e.OID)
+		if err != nil {
+			return err
+		}
+		v, err := decodePersisted(e.Kind, e.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.OID, err)
+		}
+		entries[oid.String()] = &VarBind{
+			OID:       oid,
+			ValueType: v.TypeString(),
+			Value:     v,
+			updated:   pc.Time,
+			stale:     true,
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	s := newSnapshot(c.Snapshot().generation+1, entries)
+	s.time = pc.Time
+	c.store(s, nil)
+
+	return nil
+}
+
+// LoadFile loads the entries saved to path, see Load
+func (c *Cache) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.Load(f)
+}
+
+// loadPersisted loads the persisted entries, if any, at startup
+func (p *PassPersist) loadPersisted() {
+	if p.persistPath == "" {
+		return
+	}
+
+	err := p.cache.LoadFile(p.persistPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		slog.Warn("failed to load cache file", "path", p.persistPath, slog.Any("error", err))
+		return
+	}
+
+	s := p.cache.Snapshot()
+	slog.Info("loaded stale entries", "path", p.persistPath, "entries", s.Len(), "age", time.Since(s.Time()))
+}
+
+// savePersisted schedules saving the committed entries, the commits of
+// the next persistDelay are saved together in the background
+func (p *PassPersist) savePersisted() {
+	if p.persistPath == "" {
+		return
+	}
+
+	p.persistMu.Lock()
+	defer p.persistMu.Unlock()
+
+	if p.persistTimer == nil {
+		p.persistTimer = time.AfterFunc(p.persistDelay, p.flushPersisted)
+	}
+}
+
+// flushPersisted saves the committed entries now unless a later generation
+// was already saved
+func (p *PassPersist) flushPersisted() {
+	p.persistMu.Lock()
+	if p.persistTimer != nil {
+		p.persistTimer.Stop()
+		p.persistTimer = nil
+	}
+	p.persistMu.Unlock()
+
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
+	s := p.cache.Snapshot()
+	if s.generation <= p.persisted {
+		return
+	}
+
+	if err := s.SaveFile(p.persistPath); err != nil {
+		slog.Warn("failed to save cache file", "path", p.persistPath, slog.Any("error", err))
+		return
+	}
+	p.persisted = s.generation
+}
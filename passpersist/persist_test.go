@@ -0,0 +1,146 @@
+package passpersist
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	base := MustNewOID("1.3.6.1.4.1.8072")
+	values := []typedValue{
+		{&StringVal{"hello"}},
+		{&OctetStringVal{[]byte{0, 1, 0xff}}},
+		{&IntVal{-42}},
+		{&Counter32Val{1 << 31}},
+		{&Counter64Val{1 << 63}},
+		{&GaugeVal{7}},
+		{&IPAddrVal{netip.MustParseAddr("192.0.2.1")}},
+		{&IPV6AddrVal{netip.MustParseAddr("2001:db8::1")}},
+		{&OIDVal{MustNewOID("1.3.6.1.2.1")}},
+		{&TimeTicksVal{1234567 * time.Microsecond}},
+	}
+
+	c := NewCache()
+	for i, v := range values {
+		c.Set(&VarBind{OID: base.MustAppend([]int{i}), ValueType: v.TypeString(), Value: v})
+	}
+	c.Commit()
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewCache()
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	s := loaded.Snapshot()
+	if !s.Stale() || !s.Time().Equal(c.Snapshot().Time()) {
+		t.Errorf("loaded snapshot stale %v at %s, want stale at %s", s.Stale(), s.Time(), c.Snapshot().Time())
+	}
+
+	for i, want := range values {
+		got := loaded.Get(base.MustAppend([]int{i}))
+		if got == nil {
+			t.Errorf("%d: missing", i)
+			continue
+		}
+		if got.Value.TypeString() != want.TypeString() || got.Value.String() != want.String() ||
+			berTagOf(&got.Value) != berTagOf(&want) {
+			t.Errorf("%d: got %s %s, want %s %s", i, got.Value.TypeString(), got.Value.String(), want.TypeString(), want.String())
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	base := MustNewOID("1.3.6.1.4.1.8072")
+
+	pp := NewPassPersist(WithBaseOID(base), WithPersistence(path))
+	refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+		return pp.AddString([]int{1}, "saved")
+	})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the save to be delayed, got %v", err)
+	}
+	pp.flushPersisted()
+
+	// a restart answers from the file until the first update
+	pp = NewPassPersist(WithBaseOID(base), WithPersistence(path), WithRefreshSignals())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pp.Start(ctx, nil)
+
+	if v := pp.Cache().Get(base.MustAppend([]int{1})); v == nil || v.Value.String() != "saved" {
+		t.Errorf("got %v, want the saved entry", v)
+	}
+	if !pp.Cache().Snapshot().Stale() {
+		t.Error("loaded entries are not stale")
+	}
+
+	refreshBase(ctx, pp, func(_ context.Context, pp *PassPersist) error {
+		return pp.AddString([]int{1}, "fresh")
+	})
+	if pp.Cache().Snapshot().Stale() {
+		t.Error("entries are stale after an update")
+	}
+
+	// pending saves are flushed on shutdown
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c := NewCache()
+		if c.LoadFile(path) == nil {
+			if v := c.Get(base.MustAppend([]int{1})); v != nil && v.Value.String() == "fresh" {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("updated entry was not saved on shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStaleSubtree(t *testing.T) {
+	base := MustNewOID("1.3.6.1.4.1.8072")
+	c := NewCache()
+	c.Set(&VarBind{OID: base.MustAppend([]int{1, 1}), ValueType: "string", Value: typedValue{&StringVal{"a"}}})
+	c.Set(&VarBind{OID: base.MustAppend([]int{2, 1}), ValueType: "string", Value: typedValue{&StringVal{"b"}}})
+	c.Commit()
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a commit of subtree 1 leaves the entries of 2 stale
+	c.Set(&VarBind{OID: base.MustAppend([]int{1, 1}), ValueType: "string", Value: typedValue{&StringVal{"fresh"}}})
+	c.CommitSubtree(base.MustAppend([]int{1}))
+
+	if v := c.Get(base.MustAppend([]int{1, 1})); v.Stale() {
+		t.Error("updated entry is stale")
+	}
+	if v := c.Get(base.MustAppend([]int{2, 1})); !v.Stale() {
+		t.Error("entry of another subtree is not stale")
+	}
+	if !c.Snapshot().Stale() {
+		t.Error("snapshot with stale entries is not stale")
+	}
+
+	c.Set(&VarBind{OID: base.MustAppend([]int{2, 1}), ValueType: "string", Value: typedValue{&StringVal{"fresh"}}})
+	c.CommitSubtree(base.MustAppend([]int{2}))
+	if c.Snapshot().Stale() {
+		t.Error("snapshot is stale once all subtrees were updated")
+	}
+}
@@ -0,0 +1,260 @@
+package passpersist
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// Condition reports whether an entry is in alarm given its value at the
+// previous refresh, nil for a new entry
+type Condition func(prev, cur *VarBind) bool
+
+// Above holds for numeric values greater than threshold
+func Above(threshold int64) Condition {
+	return func(_, cur *VarBind) bool {
+		c, ok := cur.Value.compareInt(threshold)
+		return ok && c > 0
+	}
+}
+
+// Below holds for numeric values less than threshold
+func Below(threshold int64) Condition {
+	return func(_, cur *VarBind) bool {
+		c, ok := cur.Value.compareInt(threshold)
+		return ok && c < 0
+	}
+}
+
+// Changed holds when the type or value differs from the previous refresh.
+// With the default Clear, changes at consecutive refreshes raise a single
+// alarm.
+func Changed() Condition {
+	return func(prev, cur *VarBind) bool {
+		return prev != nil && (prev.Value.TypeString() != cur.Value.TypeString() ||
+			prev.Value.String() != cur.Value.String())
+	}
+}
+
+// Not holds when c does not
+func Not(c Condition) Condition {
+	return func(prev, cur *VarBind) bool {
+		return !c(prev, cur)
+	}
+}
+
+// Rule raises an alarm on the entries at and below Subs for which Condition
+// holds for For consecutive updates of the entry. Each entry is evaluated
+// when a refresh or transaction writes it, and its alarm is cleared when it
+// is removed or expires. The alarm is cleared when Clear
+// holds, Not(Condition) by default, so that e.g. raising Above(90) and
+// clearing Below(80) avoids flapping.
+type Rule struct {
+	Name      string
+	Subs      []int
+	Condition Condition
+	Clear     Condition
+	// For defaults to 1
+	For int
+
+	// TrapOID and ClearTrapOID, if set, are sent as notifications with the
+	// entry when the alarm is raised and cleared, from a background queue
+	TrapOID      OID
+	ClearTrapOID OID
+
+	// Action is called with each event, events are logged when it is nil
+	Action func(Event)
+}
+
+// Event is an alarm raised or cleared by a Rule. Value is nil when the alarm
+// is cleared because the entry was removed.
+type Event struct {
+	Rule     string
+	OID      OID
+	Raised   bool
+	Value    *VarBind
+	Previous *VarBind
+}
+
+type rule struct {
+	Rule
+	oid    OID
+	states map[string]*ruleState
+}
+
+type ruleState struct {
+	prev   *VarBind
+	count  int
+	raised bool
+}
+
+type ruleEvent struct {
+	r *rule
+	e Event
+}
+
+// rules are evaluated against the entries written by each commit
+type rules struct {
+	sync.Mutex
+	list []*rule
+}
+
+// AddRule evaluates r against the entries of its subtree as they are
+// written
+func (p *PassPersist) AddRule(r Rule) error {
+	if r.Condition == nil {
+		return errors.New("rule has no condition")
+	}
+
+	oid, err := p.baseOID.Append(r.Subs)
+	if err != nil {
+		return err
+	}
+
+	if r.Clear == nil {
+		r.Clear = Not(r.Condition)
+	}
+	if r.For < 1 {
+		r.For = 1
+	}
+	if r.Name == "" {
+		r.Name = oid.String()
+	}
+
+	p = p.owner()
+	p.rules.Lock()
+	defer p.rules.Unlock()
+
+	p.rules.list = append(p.rules.list, &rule{
+		Rule:   r,
+		oid:    oid,
+		states: make(map[string]*ruleState),
+	})
+	return nil
+}
+
+func (p *PassPersist) MustAddRule(r Rule) {
+	err := p.AddRule(r)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// evaluateRules evaluates the rules against the entries written and the
+// OIDs removed by a commit and dispatches the resulting events
+func (p *PassPersist) evaluateRules(written []*VarBind, removed []OID) {
+	if len(written) == 0 && len(removed) == 0 {
+		return
+	}
+
+	var events []ruleEvent
+
+	p.rules.Lock()
+	for _, r := range p.rules.list {
+		events = r.evaluate(written, removed, events)
+	}
+	p.rules.Unlock()
+
+	for _, ev := range events {
+		p.dispatch(ev.r, ev.e)
+	}
+}
+
+// committed returns the entries of vbs which were committed to snap, in OID
+// order
+func committed(snap *Snapshot, vbs []*VarBind) []*VarBind {
+	var entries []*VarBind
+	for _, vb := range vbs {
+		if snap.entries[vb.OID.String()] == vb {
+			entries = append(entries, vb)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].OID.Compare(entries[j].OID) < 0
+	})
+	return entries
+}
+
+// removed returns the OIDs of the entries of prev at and below prefixes
+// which are not in next
+func removed(prev, next *Snapshot, prefixes []OID) []OID {
+	var oids []OID
+	for _, prefix := range prefixes {
+		prev.Walk(prefix, func(vb *VarBind) error {
+			if next.Get(vb.OID) == nil {
+				oids = append(oids, vb.OID)
+			}
+			return nil
+		})
+	}
+	return oids
+}
+
+// evaluate appends the events of the written and removed entries in the
+// subtree of r to events
+func (r *rule) evaluate(written []*VarBind, removed []OID, events []ruleEvent) []ruleEvent {
+	for _, v := range written {
+		if !v.OID.StartsWith(r.oid) {
+			continue
+		}
+
+		key := v.OID.String()
+		s, ok := r.states[key]
+		if !ok {
+			s = &ruleState{}
+			r.states[key] = s
+		}
+
+		if !s.raised {
+			if r.Condition(s.prev, v) {
+				s.count++
+			} else {
+				s.count = 0
+			}
+			if s.count >= r.For {
+				s.raised = true
+				events = append(events, ruleEvent{r, Event{r.Name, v.OID, true, v, s.prev}})
+			}
+		} else if r.Clear(s.prev, v) {
+			s.raised = false
+			s.count = 0
+			events = append(events, ruleEvent{r, Event{r.Name, v.OID, false, v, s.prev}})
+		}
+
+		s.prev = v
+	}
+
+	for _, o := range removed {
+		if !o.StartsWith(r.oid) {
+			continue
+		}
+		key := o.String()
+		if s, ok := r.states[key]; ok {
+			if s.raised {
+				events = append(events, ruleEvent{r, Event{r.Name, o, false, nil, s.prev}})
+			}
+			delete(r.states, key)
+		}
+	}
+
+	return events
+}
+
+func (p *PassPersist) dispatch(r *rule, e Event) {
+	if r.Action != nil {
+		r.Action(e)
+	} else if e.Raised {
+		slog.Warn("alarm raised", "rule", e.Rule, "oid", e.OID.String(), "value", e.Value.Value.String())
+	} else {
+		slog.Info("alarm cleared", "rule", e.Rule, "oid", e.OID.String())
+	}
+
+	trapOID := r.ClearTrapOID
+	if e.Raised {
+		trapOID = r.TrapOID
+	}
+	if len(trapOID.Value) > 0 {
+		p.queueTrap(trapOID, e.Value)
+	}
+}
@@ -0,0 +1,201 @@
+package passpersist
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRules(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	var events []Event
+	record := func(e Event) {
+		events = append(events, e)
+	}
+
+	pp.MustAddRule(Rule{
+		Name:      "load",
+		Subs:      []int{3},
+		Condition: Above(90),
+		Clear:     Below(80),
+		For:       2,
+		Action:    record,
+	})
+	pp.MustAddRule(Rule{
+		Name:      "status",
+		Subs:      []int{1, 2},
+		Condition: Changed(),
+		Action:    record,
+	})
+
+	type step struct {
+		load   []uint32
+		status string
+		want   []string
+	}
+
+	steps := []step{
+		{[]uint32{95, 10}, "up", nil},
+		{[]uint32{95, 10}, "up", []string{"load 1.3.6.1.4.1.8072.3.1 raised"}},
+		{[]uint32{85, 10}, "down", []string{"status 1.3.6.1.4.1.8072.1.2 raised"}},
+		{[]uint32{75, 10}, "down", []string{
+			"load 1.3.6.1.4.1.8072.3.1 cleared",
+			"status 1.3.6.1.4.1.8072.1.2 cleared",
+		}},
+		{[]uint32{95, 95}, "down", nil},
+		{[]uint32{95}, "down", []string{
+			"load 1.3.6.1.4.1.8072.3.1 raised",
+		}},
+	}
+
+	for i, s := range steps {
+		events = nil
+		refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+			for j, v := range s.load {
+				pp.AddGauge([]int{3, j + 1}, v)
+			}
+			pp.AddString([]int{1, 2}, s.status)
+			return nil
+		})
+
+		var got []string
+		for _, e := range events {
+			state := "cleared"
+			if e.Raised {
+				state = "raised"
+			}
+			got = append(got, e.Rule+" "+e.OID.String()+" "+state)
+		}
+
+		if len(got) != len(s.want) {
+			t.Fatalf("step %d: got events %v, want %v", i, got, s.want)
+		}
+		for j := range got {
+			if got[j] != s.want[j] {
+				t.Errorf("step %d: got event %s, want %s", i, got[j], s.want[j])
+			}
+		}
+	}
+
+	// a raised alarm is cleared when its entry goes away
+	events = nil
+	refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+		return pp.AddString([]int{1, 2}, "down")
+	})
+	if len(events) != 1 || events[0].Raised || events[0].Value != nil {
+		t.Errorf("got events %+v, want the load alarm cleared", events)
+	}
+}
+
+func TestRulesOnCommit(t *testing.T) {
+	conn := listenReceiver(t)
+
+	// informs to conn are never acknowledged
+	pp := NewPassPersist(
+		WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")),
+		WithInformReceiver(conn.LocalAddr().String(), "public", time.Minute, 0),
+	)
+
+	raised := make(chan Event, 1)
+	pp.MustAddRule(Rule{
+		Name:      "load",
+		Subs:      []int{3},
+		Condition: Above(90),
+		TrapOID:   MustNewOID("1.3.6.1.4.1.8072.9.1"),
+		Action:    func(e Event) { raised <- e },
+	})
+
+	start := time.Now()
+	tx := pp.Begin()
+	tx.AddGauge([]int{3, 1}, 95)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("commit waited %s for the notification", d)
+	}
+
+	select {
+	case e := <-raised:
+		if !e.Raised || e.OID.String() != "1.3.6.1.4.1.8072.3.1" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	default:
+		t.Fatal("expected the rule to be evaluated on commit")
+	}
+
+	msg, _ := receiveNotification(t, conn)
+	if msg.pdu.tag != pduInformRequest {
+		t.Errorf("expected an inform, got pdu 0x%02x", msg.pdu.tag)
+	}
+}
+
+func TestRulesCountEntryUpdates(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	var events []Event
+	record := func(e Event) { events = append(events, e) }
+	pp.MustAddRule(Rule{Name: "load", Subs: []int{3}, Condition: Above(90), For: 3, Action: record})
+	pp.MustAddRule(Rule{Name: "stuck", Subs: []int{4}, Condition: Not(Changed()), Action: record})
+
+	refresh := func() {
+		refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+			pp.AddGauge([]int{3, 1}, 95)
+			pp.AddString([]int{4, 1}, "same")
+			return nil
+		})
+	}
+	unrelated := func() {
+		tx := pp.Begin()
+		tx.AddString([]int{5, 1}, "other")
+		tx.Commit()
+	}
+
+	// the stuck alarm is raised on the first unchanged update
+	refresh()
+	refresh()
+	if len(events) != 1 || events[0].Rule != "stuck" || !events[0].Raised {
+		t.Fatalf("got events %+v, want the stuck alarm raised", events)
+	}
+
+	// commits of other entries neither count towards For nor clear alarms
+	events = nil
+	unrelated()
+	unrelated()
+	if len(events) != 0 {
+		t.Fatalf("got events %+v from unrelated commits", events)
+	}
+
+	refresh()
+	if len(events) != 1 || events[0].Rule != "load" || !events[0].Raised {
+		t.Errorf("got events %+v, want the load alarm raised on the third update", events)
+	}
+}
+
+func TestRulesNestedCollector(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	var events []Event
+	pp.MustAddRule(Rule{Subs: []int{2}, Condition: Above(90), Action: func(e Event) { events = append(events, e) }})
+	pp.MustAddCollector([]int{2, 1}, time.Minute, func(_ context.Context, pp *PassPersist) error {
+		return pp.AddGauge([]int{1}, 95)
+	})
+
+	// the rule is above the subtree of the collector
+	pp.refresh(context.Background(), pp.collectorsWith(nil)[0])
+	if len(events) != 1 || events[0].OID.String() != "1.3.6.1.4.1.8072.2.1.1" {
+		t.Errorf("got events %+v, want the nested entry raised", events)
+	}
+}
+
+func TestRulesCounter64Thresholds(t *testing.T) {
+	vb := &VarBind{Value: typedValue{&Counter64Val{math.MaxUint64}}}
+	if !Above(math.MaxInt64)(nil, vb) {
+		t.Error("expected a counter64 above MaxInt64 to be above the threshold")
+	}
+	if Below(0)(nil, vb) {
+		t.Error("expected a counter64 above MaxInt64 not to be below 0")
+	}
+}
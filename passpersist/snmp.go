@@ -0,0 +1,357 @@
+package passpersist
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"time"
+)
+
+// SNMP message versions
+const (
+	snmpV1  = 0
+	snmpV2c = 1
+	snmpV3  = 3
+)
+
+// PDU tags
+const (
+	pduGetRequest     byte = 0xa0
+	pduGetNextRequest byte = 0xa1
+	pduResponse       byte = 0xa2
+	pduSetRequest     byte = 0xa3
+	pduGetBulkRequest byte = 0xa5
+	pduInformRequest  byte = 0xa6
+	pduTrapV2         byte = 0xa7
+	pduReport         byte = 0xa8
+)
+
+// PDU error status
+const (
+	errNoError             = 0
+	errTooBig              = 1
+	errNoSuchName          = 2
+	errGenErr              = 5
+	errNoAccess            = 6
+	errWrongType           = 7
+	errWrongLength         = 8
+	errWrongEncoding       = 9
+	errWrongValue          = 10
+	errNoCreation          = 11
+	errInconsistentValue   = 12
+	errResourceUnavailable = 13
+	errCommitFailed        = 14
+	errUndoFailed          = 15
+	errAuthorizationError  = 16
+	errNotWritable         = 17
+	errInconsistentName    = 18
+)
+
+// errorStatus returns the PDU error status of a set error
+func (e SetError) errorStatus() int {
+	switch e {
+	case WrongType:
+		return errWrongType
+	case WrongValue:
+		return errWrongValue
+	case WrongLength:
+		return errWrongLength
+	case InconsistentValue:
+		return errInconsistentValue
+	case NotWriteable:
+		return errNotWritable
+	case NoAccess:
+		return errNoAccess
+	case WrongEncoding:
+		return errWrongEncoding
+	case NoCreation:
+		return errNoCreation
+	case ResourceUnavailable:
+		return errResourceUnavailable
+	case CommitFailed:
+		return errCommitFailed
+	case UndoFailed:
+		return errUndoFailed
+	case AuthorizationError:
+		return errAuthorizationError
+	case InconsistentName:
+		return errInconsistentName
+	}
+	return errGenErr
+}
+
+// snmpVarBind is a variable binding on the wire. Value is unset for NULL
+// values and exceptions, which are identified by tag.
+type snmpVarBind struct {
+	oid   OID
+	tag   byte
+	value typedValue
+}
+
+func newSNMPVarBind(vb *VarBind) snmpVarBind {
+	return snmpVarBind{
+		oid:   vb.OID,
+		tag:   berTagOf(&vb.Value),
+		value: vb.Value,
+	}
+}
+
+func (v snmpVarBind) marshal() []byte {
+	var val []byte
+	if v.value.Value != nil {
+		val = berTypedValue(&v.value)
+	} else {
+		val = berNull(v.tag)
+	}
+	return berSequence(tagSequence, berOID(v.oid), val)
+}
+
+type snmpPDU struct {
+	tag       byte
+	requestID int32
+	// errorStatus and errorIndex hold non-repeaters and max-repetitions
+	// of GetBulk requests
+	errorStatus int
+	errorIndex  int
+	varBinds    []snmpVarBind
+}
+
+func (p *snmpPDU) marshal() []byte {
+	vbs := make([][]byte, len(p.varBinds))
+	for i, vb := range p.varBinds {
+		vbs[i] = vb.marshal()
+	}
+
+	return berSequence(p.tag,
+		berInt(tagInteger, int64(p.requestID)),
+		berInt(tagInteger, int64(p.errorStatus)),
+		berInt(tagInteger, int64(p.errorIndex)),
+		berSequence(tagSequence, vbs...),
+	)
+}
+
+func unmarshalPDU(tag byte, content []byte) (*snmpPDU, error) {
+	p := &snmpPDU{tag: tag}
+	r := &berReader{content}
+
+	id, err := r.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	p.requestID = int32(id)
+
+	status, err := r.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	p.errorStatus = int(status)
+
+	index, err := r.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	p.errorIndex = int(index)
+
+	list, err := r.expect(tagSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	lr := &berReader{list}
+	for !lr.empty() {
+		vbc, err := lr.expect(tagSequence)
+		if err != nil {
+			return nil, err
+		}
+
+		vr := &berReader{vbc}
+		oid, err := vr.readOID()
+		if err != nil {
+			return nil, err
+		}
+
+		vtag, vcontent, err := vr.next()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := parseBERValue(vtag, vcontent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for '%s': %w", oid.String(), err)
+		}
+
+		p.varBinds = append(p.varBinds, snmpVarBind{oid: oid, tag: vtag, value: value})
+	}
+
+	return p, nil
+}
+
+// snmpMessage is a community based SNMPv1 or SNMPv2c message
+type snmpMessage struct {
+	version   int
+	community string
+	pdu       *snmpPDU
+}
+
+func (m *snmpMessage) marshal() []byte {
+	return berSequence(tagSequence,
+		berInt(tagInteger, int64(m.version)),
+		berOctets(tagOctetString, []byte(m.community)),
+		m.pdu.marshal(),
+	)
+}
+
+// peekVersion returns the version of an encoded message
+func peekVersion(b []byte) (int, error) {
+	r := &berReader{b}
+	content, err := r.expect(tagSequence)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := (&berReader{content}).readInt(tagInteger)
+	return int(v), err
+}
+
+func unmarshalMessage(b []byte) (*snmpMessage, error) {
+	r := &berReader{b}
+	content, err := r.expect(tagSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	mr := &berReader{content}
+	version, err := mr.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	if version != snmpV1 && version != snmpV2c {
+		return nil, fmt.Errorf("unsupported community message version %d", version)
+	}
+
+	community, err := mr.readOctets(tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, pduContent, err := mr.next()
+	if err != nil {
+		return nil, err
+	}
+
+	pdu, err := unmarshalPDU(tag, pduContent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snmpMessage{
+		version:   int(version),
+		community: string(community),
+		pdu:       pdu,
+	}, nil
+}
+
+// berTagOf returns the BER tag used to encode a typed value
+func berTagOf(v *typedValue) byte {
+	switch v.GetValue().(type) {
+	case *StringVal, *OctetStringVal, *IPV6AddrVal:
+		return tagOctetString
+	case *IntVal:
+		return tagInteger
+	case *Counter32Val:
+		return tagCounter32
+	case *Counter64Val:
+		return tagCounter64
+	case *GaugeVal:
+		return tagGauge32
+	case *IPAddrVal:
+		return tagIPAddress
+	case *OIDVal:
+		return tagOID
+	case *TimeTicksVal:
+		return tagTimeTicks
+	}
+	return tagNull
+}
+
+// berTypedValue encodes a typed value, time ticks are encoded in hundredths
+// of a second
+func berTypedValue(v *typedValue) []byte {
+	switch x := v.GetValue().(type) {
+	case *StringVal:
+		return berOctets(tagOctetString, []byte(x.Value))
+	case *OctetStringVal:
+		return berOctets(tagOctetString, x.Value)
+	case *IPV6AddrVal:
+		a := x.Value.As16()
+		return berOctets(tagOctetString, a[:])
+	case *IntVal:
+		return berInt(tagInteger, int64(x.Value))
+	case *Counter32Val:
+		return berUint(tagCounter32, uint64(x.Value))
+	case *Counter64Val:
+		return berUint(tagCounter64, x.Value)
+	case *GaugeVal:
+		return berUint(tagGauge32, uint64(x.Value))
+	case *IPAddrVal:
+		a := x.Value.As4()
+		return berOctets(tagIPAddress, a[:])
+	case *OIDVal:
+		return berOID(x.Value)
+	case *TimeTicksVal:
+		return berUint(tagTimeTicks, uint64(uint32(x.Value/(10*time.Millisecond))))
+	}
+	return berNull(tagNull)
+}
+
+// parseBERValue decodes a value, octet strings are decoded as
+// OctetStringVal. NULL values and exceptions return an empty typedValue.
+func parseBERValue(tag byte, content []byte) (typedValue, error) {
+	switch tag {
+	case tagNull, tagNoSuchObject, tagNoSuchInstance, tagEndOfMibView:
+		return typedValue{}, nil
+	case tagInteger:
+		i, err := berParseInt(content)
+		if err != nil {
+			return typedValue{}, err
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return typedValue{}, fmt.Errorf("integer %d out of range", i)
+		}
+		return typedValue{&IntVal{int32(i)}}, nil
+	case tagOctetString:
+		b := make([]byte, len(content))
+		copy(b, content)
+		return typedValue{&OctetStringVal{b}}, nil
+	case tagOID:
+		o, err := berParseOID(content)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&OIDVal{o}}, nil
+	case tagIPAddress:
+		if len(content) != 4 {
+			return typedValue{}, fmt.Errorf("invalid ip address length %d", len(content))
+		}
+		return typedValue{&IPAddrVal{netip.AddrFrom4([4]byte(content))}}, nil
+	case tagCounter32, tagGauge32, tagTimeTicks, tagCounter64:
+		i, err := berParseUint(content)
+		if err != nil {
+			return typedValue{}, err
+		}
+		if tag != tagCounter64 && i > math.MaxUint32 {
+			return typedValue{}, fmt.Errorf("unsigned %d out of range", i)
+		}
+		switch tag {
+		case tagCounter32:
+			return typedValue{&Counter32Val{uint32(i)}}, nil
+		case tagGauge32:
+			return typedValue{&GaugeVal{uint32(i)}}, nil
+		case tagTimeTicks:
+			return typedValue{&TimeTicksVal{time.Duration(i) * 10 * time.Millisecond}}, nil
+		default:
+			return typedValue{&Counter64Val{i}}, nil
+		}
+	}
+	return typedValue{}, fmt.Errorf("unsupported value tag 0x%02x", tag)
+}
@@ -0,0 +1,426 @@
+package passpersist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// SNMPv3 message flags
+const (
+	msgFlagAuth       byte = 0x01
+	msgFlagPriv       byte = 0x02
+	msgFlagReportable byte = 0x04
+)
+
+const securityModelUSM = 3
+
+// USM statistics reported to managers, RFC 3414 section 5
+const (
+	usmStatsUnsupportedSecLevels = iota + 1
+	usmStatsNotInTimeWindows
+	usmStatsUnknownUserNames
+	usmStatsUnknownEngineIDs
+	usmStatsWrongDigests
+	usmStatsDecryptionErrors
+)
+
+var usmStatsOID = MustNewOID("1.3.6.1.6.3.15.1.1")
+
+// timeWindow is the number of seconds a message may be late or early
+const timeWindow = 150
+
+type usmSecurityParameters struct {
+	engineID   []byte
+	boots      int32
+	time       int32
+	userName   string
+	authParams []byte
+	privParams []byte
+}
+
+func (s *usmSecurityParameters) marshal() []byte {
+	return berSequence(tagSequence,
+		berOctets(tagOctetString, s.engineID),
+		berInt(tagInteger, int64(s.boots)),
+		berInt(tagInteger, int64(s.time)),
+		berOctets(tagOctetString, []byte(s.userName)),
+		berOctets(tagOctetString, s.authParams),
+		berOctets(tagOctetString, s.privParams),
+	)
+}
+
+func unmarshalUSMParameters(b []byte) (*usmSecurityParameters, error) {
+	content, err := (&berReader{b}).expect(tagSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &berReader{content}
+	s := &usmSecurityParameters{}
+
+	if s.engineID, err = r.readOctets(tagOctetString); err != nil {
+		return nil, err
+	}
+	boots, err := r.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	s.boots = int32(boots)
+
+	t, err := r.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	s.time = int32(t)
+
+	name, err := r.readOctets(tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	s.userName = string(name)
+
+	if s.authParams, err = r.readOctets(tagOctetString); err != nil {
+		return nil, err
+	}
+	if s.privParams, err = r.readOctets(tagOctetString); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// v3Message is an SNMPv3 message using the User-based Security Model
+type v3Message struct {
+	msgID   int32
+	maxSize int32
+	flags   byte
+	sec     usmSecurityParameters
+
+	contextEngineID []byte
+	contextName     []byte
+	pdu             *snmpPDU
+
+	// set when unmarshaling
+	encryptedPDU []byte
+	authOffset   int
+}
+
+// marshal encodes the message, encrypting and authenticating it with u as
+// requested by the message flags. salt is used for encryption.
+func (m *v3Message) marshal(u *usmUser, salt uint64) ([]byte, error) {
+	data := berSequence(tagSequence,
+		berOctets(tagOctetString, m.contextEngineID),
+		berOctets(tagOctetString, m.contextName),
+		m.pdu.marshal(),
+	)
+
+	sec := m.sec
+	sec.authParams = nil
+	sec.privParams = nil
+
+	if m.flags&msgFlagPriv != 0 {
+		sec.privParams = make([]byte, 8)
+		binary.BigEndian.PutUint64(sec.privParams, salt)
+
+		enc, err := u.encrypt(data, sec.boots, sec.time, sec.privParams)
+		if err != nil {
+			return nil, err
+		}
+		data = berOctets(tagOctetString, enc)
+	}
+
+	if m.flags&msgFlagAuth != 0 {
+		sec.authParams = make([]byte, u.auth.macLen())
+	}
+
+	b := berSequence(tagSequence,
+		berInt(tagInteger, snmpV3),
+		berSequence(tagSequence,
+			berInt(tagInteger, int64(m.msgID)),
+			berInt(tagInteger, int64(m.maxSize)),
+			berOctets(tagOctetString, []byte{m.flags}),
+			berInt(tagInteger, securityModelUSM),
+		),
+		berOctets(tagOctetString, sec.marshal()),
+		data,
+	)
+
+	if m.flags&msgFlagAuth != 0 {
+		// the privacy parameters and the data follow the authentication
+		// parameters
+		privParams := berOctets(tagOctetString, sec.privParams)
+		u.authenticate(b, len(b)-len(data)-len(privParams)-len(sec.authParams))
+	}
+
+	return b, nil
+}
+
+// unmarshalV3Message decodes a message, an encrypted scoped PDU is left in
+// encryptedPDU
+func unmarshalV3Message(b []byte) (*v3Message, error) {
+	content, err := (&berReader{b}).expect(tagSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &berReader{content}
+	version, err := r.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	if version != snmpV3 {
+		return nil, fmt.Errorf("unsupported message version %d", version)
+	}
+
+	global, err := r.expect(tagSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &v3Message{}
+	gr := &berReader{global}
+
+	id, err := gr.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	m.msgID = int32(id)
+
+	maxSize, err := gr.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	m.maxSize = int32(maxSize)
+
+	flags, err := gr.readOctets(tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	if len(flags) != 1 {
+		return nil, fmt.Errorf("invalid message flags length %d", len(flags))
+	}
+	m.flags = flags[0]
+
+	model, err := gr.readInt(tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	if model != securityModelUSM {
+		return nil, fmt.Errorf("unsupported security model %d", model)
+	}
+
+	secParams, err := r.readOctets(tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+
+	sec, err := unmarshalUSMParameters(secParams)
+	if err != nil {
+		return nil, err
+	}
+	m.sec = *sec
+	// sub-slices share the backing array of b, the difference of their
+	// capacities is the position of the authentication parameters in b
+	m.authOffset = cap(b) - cap(sec.authParams)
+
+	tag, data, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case tagOctetString:
+		m.encryptedPDU = data
+	case tagSequence:
+		if err := m.unmarshalScopedPDU(data); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid scoped pdu tag 0x%02x", tag)
+	}
+
+	return m, nil
+}
+
+func (m *v3Message) unmarshalScopedPDU(content []byte) error {
+	r := &berReader{content}
+
+	var err error
+	if m.contextEngineID, err = r.readOctets(tagOctetString); err != nil {
+		return err
+	}
+	if m.contextName, err = r.readOctets(tagOctetString); err != nil {
+		return err
+	}
+
+	tag, pdu, err := r.next()
+	if err != nil {
+		return err
+	}
+
+	m.pdu, err = unmarshalPDU(tag, pdu)
+	return err
+}
+
+// decrypt decodes the encrypted scoped PDU with the keys of u
+func (m *v3Message) decrypt(u *usmUser) error {
+	plain, err := u.decrypt(m.encryptedPDU, m.sec.boots, m.sec.time, m.sec.privParams)
+	if err != nil {
+		return err
+	}
+
+	content, err := (&berReader{plain}).expect(tagSequence)
+	if err != nil {
+		return err
+	}
+
+	return m.unmarshalScopedPDU(content)
+}
+
+func (a *Agent) engineTime() int32 {
+	return int32(time.Since(a.startTime).Seconds())
+}
+
+// handleV3 processes an SNMPv3 message per RFC 3414 section 3.2
+func (a *Agent) handleV3(b []byte) []byte {
+	msg, err := unmarshalV3Message(b)
+	if err != nil {
+		slog.Debug("dropping invalid message", slog.Any("error", err))
+		return nil
+	}
+
+	auth := msg.flags&msgFlagAuth != 0
+	priv := msg.flags&msgFlagPriv != 0
+	if priv && !auth {
+		slog.Debug("dropping message with invalid flags", "flags", msg.flags)
+		return nil
+	}
+
+	if !bytes.Equal(msg.sec.engineID, a.engineID) {
+		return a.report(msg, nil, usmStatsUnknownEngineIDs)
+	}
+
+	u, ok := a.users[msg.sec.userName]
+	if !ok {
+		slog.Debug("unknown user", "user", msg.sec.userName)
+		return a.report(msg, nil, usmStatsUnknownUserNames)
+	}
+
+	// users are always authenticated and private if they have a privacy
+	// protocol
+	if !auth || priv != (u.priv != PrivNone) {
+		slog.Debug("unsupported security level", "user", u.name, "flags", msg.flags)
+		return a.report(msg, nil, usmStatsUnsupportedSecLevels)
+	}
+
+	if !u.verify(b, msg.authOffset) {
+		slog.Debug("wrong digest", "user", u.name)
+		return a.report(msg, nil, usmStatsWrongDigests)
+	}
+
+	if msg.sec.boots != a.engineBoots || msg.sec.boots == 2147483647 ||
+		abs(int64(msg.sec.time)-int64(a.engineTime())) > timeWindow {
+		slog.Debug("not in time window", "user", u.name, "boots", msg.sec.boots, "time", msg.sec.time)
+		return a.report(msg, u, usmStatsNotInTimeWindows)
+	}
+
+	if priv {
+		if err := msg.decrypt(u); err != nil {
+			slog.Debug("decryption failed", "user", u.name, slog.Any("error", err))
+			return a.report(msg, nil, usmStatsDecryptionErrors)
+		}
+	} else if msg.pdu == nil {
+		slog.Debug("dropping encrypted message without privacy flag", "user", u.name)
+		return nil
+	}
+
+	maxSize := a.maxMessageSize
+	if msg.maxSize > 0 && int(msg.maxSize) < maxSize {
+		maxSize = int(msg.maxSize)
+	}
+
+	resp := a.respond(snmpV2c, msg.pdu, maxSize)
+	if resp == nil {
+		return nil
+	}
+
+	return fitResponse(msg.pdu, resp, maxSize, func(p *snmpPDU) []byte {
+		b, err := a.secure(msg, u, msg.flags&(msgFlagAuth|msgFlagPriv), p)
+		if err != nil {
+			slog.Error("failed to encode response", slog.Any("error", err))
+		}
+		return b
+	})
+}
+
+// secure encodes pdu as the reply to msg
+func (a *Agent) secure(msg *v3Message, u *usmUser, flags byte, pdu *snmpPDU) ([]byte, error) {
+	userName := msg.sec.userName
+	if u != nil {
+		userName = u.name
+	}
+
+	reply := &v3Message{
+		msgID:   msg.msgID,
+		maxSize: int32(a.maxMessageSize),
+		flags:   flags,
+		sec: usmSecurityParameters{
+			engineID: a.engineID,
+			boots:    a.engineBoots,
+			time:     a.engineTime(),
+			userName: userName,
+		},
+		contextEngineID: a.engineID,
+		contextName:     msg.contextName,
+		pdu:             pdu,
+	}
+
+	return reply.marshal(u, a.salt.Add(1))
+}
+
+// report answers msg with a Report PDU carrying the USM statistic stat if
+// msg is reportable. The report is authenticated when u is given.
+func (a *Agent) report(msg *v3Message, u *usmUser, stat int) []byte {
+	count := a.usmStats[stat].Add(1)
+
+	if msg.flags&msgFlagReportable == 0 {
+		return nil
+	}
+
+	var requestID int32
+	if msg.pdu != nil {
+		requestID = msg.pdu.requestID
+	}
+
+	pdu := &snmpPDU{
+		tag:       pduReport,
+		requestID: requestID,
+		varBinds: []snmpVarBind{{
+			oid:   usmStatsOID.MustAppend([]int{stat, 0}),
+			tag:   tagCounter32,
+			value: typedValue{&Counter32Val{count}},
+		}},
+	}
+
+	var flags byte
+	if u != nil {
+		flags = msgFlagAuth
+	}
+
+	b, err := a.secure(msg, u, flags, pdu)
+	if err != nil {
+		slog.Error("failed to encode report", slog.Any("error", err))
+		return nil
+	}
+	return b
+}
+
+func abs(i int64) int64 {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
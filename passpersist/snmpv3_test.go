@@ -0,0 +1,147 @@
+package passpersist
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// v3Request sends pdu as user u, which must have keys localized to the
+// agent's engine ID, and returns the decoded response
+func v3Request(t *testing.T, addr net.Addr, u *usmUser, engineID []byte, boots int32, engineTime int32, flags byte, pdu *snmpPDU) *v3Message {
+	t.Helper()
+
+	name := ""
+	if u != nil {
+		name = u.name
+	}
+
+	req := &v3Message{
+		msgID:   pdu.requestID,
+		maxSize: 65507,
+		flags:   flags | msgFlagReportable,
+		sec: usmSecurityParameters{
+			engineID: engineID,
+			boots:    boots,
+			time:     engineTime,
+			userName: name,
+		},
+		contextEngineID: engineID,
+		pdu:             pdu,
+	}
+
+	b, err := req.marshal(u, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := exchange(t, addr, b)
+	if resp == nil {
+		return nil
+	}
+
+	msg, err := unmarshalV3Message(resp)
+	if err != nil {
+		t.Fatalf("invalid response: %s", err)
+	}
+	if msg.msgID != req.msgID {
+		t.Errorf("expected msg id %d, got %d", req.msgID, msg.msgID)
+	}
+
+	if msg.flags&msgFlagAuth != 0 && !u.verify(resp, msg.authOffset) {
+		t.Errorf("failed to verify response")
+	}
+	if msg.flags&msgFlagPriv != 0 {
+		if err := msg.decrypt(u); err != nil {
+			t.Fatalf("failed to decrypt response: %s", err)
+		}
+	}
+
+	return msg
+}
+
+func expectReport(t *testing.T, msg *v3Message, stat int) {
+	t.Helper()
+
+	if msg == nil {
+		t.Fatal("no response")
+	}
+	if msg.pdu.tag != pduReport {
+		t.Fatalf("expected report, got pdu 0x%02x", msg.pdu.tag)
+	}
+	want := usmStatsOID.MustAppend([]int{stat, 0})
+	if got := msg.pdu.varBinds[0].oid; !got.Equal(want) {
+		t.Errorf("expected report of %s, got %s", want, got)
+	}
+}
+
+func TestAgentV3(t *testing.T) {
+	engineID := []byte{0x80, 0x00, 0x1f, 0x88, 0x04, 't', 'e', 's', 't'}
+	addr := startTestAgent(t, newTestAgent(t, newTestCache(),
+		WithEngineID(engineID),
+		WithEngineBoots(3),
+		WithUSMUser("authonly", AuthSHA256, "authpassword", PrivNone, ""),
+		WithUSMUser("private", AuthSHA, "authpassword", PrivAES, "privpassword"),
+	))
+
+	get := func(id int32) *snmpPDU {
+		return &snmpPDU{tag: pduGetRequest, requestID: id, varBinds: nullVarBinds("1.3.6.1.4.1.8072.1.0")}
+	}
+
+	// engine discovery
+	msg := v3Request(t, addr, nil, nil, 0, 0, 0, get(1))
+	expectReport(t, msg, usmStatsUnknownEngineIDs)
+	if string(msg.sec.engineID) != string(engineID) || msg.sec.boots != 3 {
+		t.Errorf("unexpected engine %x/%d", msg.sec.engineID, msg.sec.boots)
+	}
+
+	authOnly, _ := newUSMUser("authonly", AuthSHA256, "authpassword", PrivNone, "", engineID)
+	private, _ := newUSMUser("private", AuthSHA, "authpassword", PrivAES, "privpassword", engineID)
+	wrong, _ := newUSMUser("private", AuthSHA, "wrongpassword", PrivAES, "privpassword", engineID)
+	unknown, _ := newUSMUser("unknown", AuthSHA, "authpassword", PrivNone, "", engineID)
+
+	for _, tt := range []struct {
+		u     *usmUser
+		flags byte
+	}{
+		{authOnly, msgFlagAuth},
+		{private, msgFlagAuth | msgFlagPriv},
+	} {
+		msg = v3Request(t, addr, tt.u, engineID, 3, 0, tt.flags, get(2))
+		if msg == nil || msg.pdu.tag != pduResponse {
+			t.Fatalf("%s: expected response, got %+v", tt.u.name, msg)
+		}
+		if msg.flags&(msgFlagAuth|msgFlagPriv) != tt.flags {
+			t.Errorf("%s: expected response flags %d, got %d", tt.u.name, tt.flags, msg.flags)
+		}
+		if got := string(msg.pdu.varBinds[0].value.GetOctetStringVal()); got != "hello" {
+			t.Errorf("%s: unexpected value '%s'", tt.u.name, got)
+		}
+	}
+
+	expectReport(t, v3Request(t, addr, unknown, engineID, 3, 0, msgFlagAuth, get(3)), usmStatsUnknownUserNames)
+	expectReport(t, v3Request(t, addr, wrong, engineID, 3, 0, msgFlagAuth|msgFlagPriv, get(4)), usmStatsWrongDigests)
+	expectReport(t, v3Request(t, addr, private, engineID, 3, 0, msgFlagAuth, get(5)), usmStatsUnsupportedSecLevels)
+
+	msg = v3Request(t, addr, private, engineID, 2, 0, msgFlagAuth|msgFlagPriv, get(6))
+	expectReport(t, msg, usmStatsNotInTimeWindows)
+	if msg.flags&msgFlagAuth == 0 {
+		t.Errorf("expected time window report to be authenticated")
+	}
+}
+
+func TestAgentV3TimeWindow(t *testing.T) {
+	engineID := newEngineID()
+	a := newTestAgent(t, newTestCache(), WithEngineID(engineID), WithUSMUser("user", AuthSHA, "authpassword", PrivNone, ""))
+	a.startTime = time.Now().Add(-time.Hour)
+	addr := startTestAgent(t, a)
+
+	u, _ := newUSMUser("user", AuthSHA, "authpassword", PrivNone, "", engineID)
+	get := &snmpPDU{tag: pduGetRequest, requestID: 1, varBinds: nullVarBinds("1.3.6.1.4.1.8072.1.0")}
+
+	expectReport(t, v3Request(t, addr, u, engineID, 1, 0, msgFlagAuth, get), usmStatsNotInTimeWindows)
+
+	if msg := v3Request(t, addr, u, engineID, 1, 3600, msgFlagAuth, get); msg == nil || msg.pdu.tag != pduResponse {
+		t.Errorf("expected response within the time window, got %+v", msg)
+	}
+}
@@ -0,0 +1,358 @@
+package passpersist
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fieldKind int
+
+const (
+	fieldScalar fieldKind = iota
+	fieldStruct
+	fieldTable
+)
+
+// structField is a struct field tagged with snmp:"N[,type][,index][,implied][,displayhint=H]"
+type structField struct {
+	field   int
+	kind    fieldKind
+	column  Column
+	index   bool
+	implied bool
+}
+
+// columnTypes maps the type names of tags to column types, they are those
+// of the pass protocol
+var columnTypes = map[string]ColumnType{
+	"string":      ColumnString,
+	"octet":       ColumnOctetString,
+	"integer":     ColumnInt,
+	"counter":     ColumnCounter32,
+	"counter32":   ColumnCounter32,
+	"counter64":   ColumnCounter64,
+	"gauge":       ColumnGauge,
+	"unsigned":    ColumnGauge,
+	"timeticks":   ColumnTimeTicks,
+	"ipaddress":   ColumnIP,
+	"ipv6address": ColumnIPV6,
+	"objectid":    ColumnOID,
+}
+
+var (
+	oidType      = reflect.TypeOf(OID{})
+	addrType     = reflect.TypeOf(netip.Addr{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	bytesType    = reflect.TypeOf([]byte{})
+)
+
+// structFields caches the tagged fields of struct types
+var structFields sync.Map
+
+// inferColumnType returns the column type of fields tagged without a type
+func inferColumnType(t reflect.Type) (ColumnType, bool) {
+	switch {
+	case t == oidType:
+		return ColumnOID, true
+	case t == addrType:
+		return ColumnIP, true
+	case t == durationType:
+		return ColumnTimeTicks, true
+	case t == bytesType:
+		return ColumnOctetString, true
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return ColumnString, true
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return ColumnInt, true
+	case reflect.Uint64:
+		return ColumnCounter64, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return ColumnGauge, true
+	}
+	return 0, false
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+func parseStructTag(f reflect.StructField, tag string) (structField, error) {
+	sf := structField{column: Column{Name: f.Name}}
+
+	// display hints may contain commas, e.g. of DateAndTime
+	if i := strings.Index(tag, ",displayhint="); i >= 0 {
+		sf.column.DisplayHint = tag[i+len(",displayhint="):]
+		tag = tag[:i]
+	}
+
+	parts := strings.Split(tag, ",")
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return sf, fmt.Errorf("field %s: invalid sub-identifier '%s'", f.Name, parts[0])
+	}
+	sf.column.Number = n
+
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "":
+		case "index":
+			sf.index = true
+		case "implied":
+			sf.index = true
+			sf.implied = true
+		default:
+			t, ok := columnTypes[opt]
+			if !ok {
+				return sf, fmt.Errorf("field %s: unknown type or option '%s'", f.Name, opt)
+			}
+			sf.column.Type = t
+		}
+	}
+
+	if n == 0 && !sf.index {
+		return sf, fmt.Errorf("field %s: sub-identifier 0 is only allowed on index fields", f.Name)
+	}
+
+	if sf.column.Type != 0 {
+		return sf, nil
+	}
+
+	ft := indirect(f.Type)
+	if t, ok := inferColumnType(ft); ok {
+		sf.column.Type = t
+		return sf, nil
+	}
+
+	switch {
+	case ft.Kind() == reflect.Struct:
+		sf.kind = fieldStruct
+	case ft.Kind() == reflect.Slice && indirect(ft.Elem()).Kind() == reflect.Struct:
+		sf.kind = fieldTable
+	default:
+		return sf, fmt.Errorf("field %s: cannot infer the type of %s", f.Name, f.Type)
+	}
+	if sf.index {
+		return sf, fmt.Errorf("field %s: index must be a scalar", f.Name)
+	}
+	return sf, nil
+}
+
+// fieldsOf returns the tagged fields of struct type t
+func fieldsOf(t reflect.Type) ([]structField, error) {
+	type result struct {
+		fields []structField
+		err    error
+	}
+	if r, ok := structFields.Load(t); ok {
+		return r.(result).fields, r.(result).err
+	}
+
+	var fields []structField
+	var err error
+	for i := 0; i < t.NumField() && err == nil; i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("snmp")
+		if !ok || tag == "-" || !f.IsExported() {
+			continue
+		}
+
+		var sf structField
+		if sf, err = parseStructTag(f, tag); err == nil {
+			sf.field = i
+			fields = append(fields, sf)
+		}
+	}
+
+	structFields.Store(t, result{fields, err})
+	return fields, err
+}
+
+// AddStruct adds the fields of struct v tagged with their sub-identifier
+// and, optionally, type below subs, e.g.
+//
+//	type Interface struct {
+//		Index    int    `snmp:"1,integer,index"`
+//		Name     string `snmp:"2,string,displayhint=255a"`
+//		InOctets uint64 `snmp:"6,counter64"`
+//	}
+//
+// The types of the pass protocol are supported, the type of untyped fields
+// is inferred. A display hint renders string fields from integers or octets.
+// Tagged struct fields are added below their sub-identifier, and slices of
+// structs as tables whose entry is subs.N.1 and whose INDEX is made of the
+// fields tagged index or implied, or the position of the row from 1 when
+// there are none. Only index fields may be numbered 0, they are then not
+// added as columns. Nil pointers are left out.
+func (p *PassPersist) AddStruct(subs []int, v any) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("cannot add %T as a struct", v)
+	}
+	return p.addStruct(subs, rv)
+}
+
+// MustAddStruct is like AddStruct but panics on error
+func (p *PassPersist) MustAddStruct(subs []int, v any) {
+	err := p.AddStruct(subs, v)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// fieldValue returns the value of field f of struct v, false for nil
+// pointers
+func fieldValue(v reflect.Value, f structField) (reflect.Value, bool) {
+	fv := v.Field(f.field)
+	for fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			return fv, false
+		}
+		fv = fv.Elem()
+	}
+	return fv, true
+}
+
+func (p *PassPersist) addStruct(subs []int, v reflect.Value) error {
+	fields, err := fieldsOf(v.Type())
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		fv, ok := fieldValue(v, f)
+		if !ok {
+			continue
+		}
+
+		fsubs := Index(subs, []int{f.column.Number})
+		switch f.kind {
+		case fieldStruct:
+			err = p.addStruct(fsubs, fv)
+		case fieldTable:
+			err = p.addTable(Index(fsubs, []int{1}), fv)
+		default:
+			err = p.addField(fsubs, f.column, fv)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PassPersist) addField(subs []int, c Column, fv reflect.Value) error {
+	tv, err := columnValue(c, fv.Interface())
+	if err != nil {
+		return fmt.Errorf("field %s: %w", c.Name, err)
+	}
+	return p.AddEntry(subs, tv)
+}
+
+// indexOf returns the INDEX component of field f
+func indexOf(f structField) (IndexComponent, error) {
+	c := IndexComponent{Name: f.column.Name}
+	switch f.column.Type {
+	case ColumnInt, ColumnCounter32, ColumnGauge:
+		c.Type = IndexInt
+	case ColumnString, ColumnOctetString:
+		c.Type = IndexOctetString
+		if f.implied {
+			c.Type = IndexImpliedOctetString
+		}
+	case ColumnIP:
+		c.Type = IndexIPAddress
+	case ColumnIPV6:
+		c.Type = IndexInetAddress
+	case ColumnOID:
+		c.Type = IndexOID
+		if f.implied {
+			c.Type = IndexImpliedOID
+		}
+	default:
+		return c, fmt.Errorf("field %s: cannot be used as an index", f.column.Name)
+	}
+	if f.implied && c.Type != IndexImpliedOctetString && c.Type != IndexImpliedOID {
+		return c, fmt.Errorf("field %s: only octet strings and OIDs can be implied", f.column.Name)
+	}
+	return c, nil
+}
+
+// addTable adds the elements of slice v as the rows of the table at entry
+func (p *PassPersist) addTable(entry []int, v reflect.Value) error {
+	fields, err := fieldsOf(indirect(v.Type().Elem()))
+	if err != nil {
+		return err
+	}
+
+	var index []structField
+	for _, f := range fields {
+		if f.kind != fieldScalar {
+			return fmt.Errorf("field %s: tables cannot be nested", f.column.Name)
+		}
+		if f.index {
+			if len(index) > 0 && index[len(index)-1].implied {
+				return errors.New("only the last index can be implied")
+			}
+			index = append(index, f)
+		}
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		row := v.Index(i)
+		for row.Kind() == reflect.Pointer && !row.IsNil() {
+			row = row.Elem()
+		}
+		if row.Kind() == reflect.Pointer {
+			continue
+		}
+
+		suffix := IntIndex(uint32(i + 1))
+		if len(index) > 0 {
+			suffix = nil
+			for _, f := range index {
+				fv, ok := fieldValue(row, f)
+				if !ok {
+					return fmt.Errorf("row %d has no value for index %s", i, f.column.Name)
+				}
+				c, err := indexOf(f)
+				if err != nil {
+					return err
+				}
+				subs, err := encodeIndex(c, fv.Interface())
+				if err != nil {
+					return fmt.Errorf("row %d: index %s: %w", i, f.column.Name, err)
+				}
+				suffix = append(suffix, subs...)
+			}
+		}
+
+		for _, f := range fields {
+			if f.column.Number == 0 {
+				continue
+			}
+			fv, ok := fieldValue(row, f)
+			if !ok {
+				continue
+			}
+			if err := p.addField(Index(entry, []int{f.column.Number}, suffix), f.column, fv); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
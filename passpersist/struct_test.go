@@ -0,0 +1,152 @@
+package passpersist
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddStruct(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	type iface struct {
+		Index    int    `snmp:"1,integer,index"`
+		Name     string `snmp:"2,string,displayhint=4a"`
+		MAC      []byte `snmp:"3,string,displayhint=1x:"`
+		InOctets uint64 `snmp:"4,counter64"`
+		Skipped  string
+	}
+	type peer struct {
+		Addr  netip.Addr `snmp:"0,index"`
+		State int        `snmp:"2"`
+	}
+	type system struct {
+		Descr  string        `snmp:"1"`
+		Uptime time.Duration `snmp:"2"`
+		Temp   int           `snmp:"3,string,displayhint=d-1"`
+		Ignore *int          `snmp:"4,integer"`
+		Ifaces []iface       `snmp:"5"`
+		Peers  []*peer       `snmp:"6"`
+		Info   struct {
+			A uint32 `snmp:"1,gauge"`
+		} `snmp:"7"`
+		Names []struct {
+			V string `snmp:"1"`
+		} `snmp:"8"`
+	}
+
+	s := system{
+		Descr:  "router",
+		Uptime: time.Second,
+		Temp:   415,
+		Ifaces: []iface{
+			{1, "eth0.100", []byte{0, 0x1c, 0x73, 0xaa}, 42, "x"},
+			{2, "lo", nil, 0, "y"},
+		},
+		Peers: []*peer{{netip.MustParseAddr("192.0.2.1"), 6}, nil},
+	}
+	s.Info.A = 7
+	s.Names = append(s.Names, struct {
+		V string `snmp:"1"`
+	}{"first"})
+
+	refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+		return pp.AddStruct([]int{1}, &s)
+	})
+
+	want := []string{
+		"1.3.6.1.4.1.8072.1.1=router",
+		"1.3.6.1.4.1.8072.1.2=1s",
+		"1.3.6.1.4.1.8072.1.3=41.5",
+		"1.3.6.1.4.1.8072.1.5.1.1.1=1",
+		"1.3.6.1.4.1.8072.1.5.1.1.2=2",
+		"1.3.6.1.4.1.8072.1.5.1.2.1=eth0.100",
+		"1.3.6.1.4.1.8072.1.5.1.2.2=lo",
+		"1.3.6.1.4.1.8072.1.5.1.3.1=00:1c:73:aa",
+		"1.3.6.1.4.1.8072.1.5.1.3.2=",
+		"1.3.6.1.4.1.8072.1.5.1.4.1=42",
+		"1.3.6.1.4.1.8072.1.5.1.4.2=0",
+		"1.3.6.1.4.1.8072.1.6.1.2.192.0.2.1=6",
+		"1.3.6.1.4.1.8072.1.7.1=7",
+		"1.3.6.1.4.1.8072.1.8.1.1.1=first",
+	}
+	var got []string
+	pp.Cache().Walk(OID{}, func(vb *VarBind) error {
+		got = append(got, vb.OID.String()+"="+vb.Value.String())
+		return nil
+	})
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	invalid := []any{
+		42,
+		struct {
+			A int `snmp:"x"`
+		}{},
+		struct {
+			A int `snmp:"1,float"`
+		}{},
+		struct {
+			A chan int `snmp:"1"`
+		}{},
+		struct {
+			A []struct {
+				B int `snmp:"1,implied"`
+			} `snmp:"1"`
+		}{A: []struct {
+			B int `snmp:"1,implied"`
+		}{{1}}},
+		// sub-identifier 0 on a column
+		struct {
+			A int `snmp:"0"`
+		}{1},
+	}
+	for _, v := range invalid {
+		if err := pp.AddStruct([]int{2}, v); err == nil {
+			t.Errorf("%#v: expected an error", v)
+		}
+	}
+}
+
+func TestDisplayHint(t *testing.T) {
+	tests := []struct {
+		hint  string
+		value any
+		want  string
+	}{
+		{"255a", "hello", "hello"},
+		{"3a", "hello", "hello"},
+		{"1x:", []byte{0, 0x1c, 0xff}, "00:1c:ff"},
+		{"1d.1d.1d.1d", []byte{10, 0, 0, 1}, "10.0.0.1"},
+		{"2d-1d-1d,1d:1d:1d.1d", []byte{0x07, 0xea, 10, 16, 12, 30, 5, 0}, "2026-10-16,12:30:5.0"},
+		{"*1d./", []byte{2, 1, 2, 1, 3}, "1.2/3"},
+		{"2x", []byte{0x01, 0x02, 0x03}, "010203"},
+		{"d-2", 1234, "12.34"},
+		{"d-2", -5, "-0.05"},
+		{"d", uint8(7), "7"},
+		{"x", 255, "ff"},
+		{"b", 5, "101"},
+		{"d", uint64(1<<63 + 1), "9223372036854775809"},
+		{"x", ^uint64(0), "ffffffffffffffff"},
+		{"d-2", uint64(1 << 63), "92233720368547758.08"},
+		{"d", int64(-1 << 63), "-9223372036854775808"},
+	}
+	for _, tt := range tests {
+		got, err := formatDisplayHint(tt.hint, tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got '%s', %v, want '%s'", tt.hint, got, err, tt.want)
+		}
+	}
+
+	for _, hint := range []string{"", "a", "1z", "d-x", "0x", "1x:0a"} {
+		if _, err := formatDisplayHint(hint, []byte{1}); err == nil {
+			t.Errorf("%s: expected an error", hint)
+		}
+		if _, err := formatDisplayHint(hint, 1); err == nil {
+			t.Errorf("%s: expected an error for an integer", hint)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package passpersist
+
+import (
+	"sort"
+	"sync"
+)
+
+type ChangeKind int
+
+const (
+	ChangeAdded ChangeKind = iota + 1
+	ChangeRemoved
+	ChangeModified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// Change is the difference of an entry between two generations of the
+// cache. Old is nil when the entry was added and New when it was removed.
+type Change struct {
+	Kind       ChangeKind
+	OID        OID
+	Old        *VarBind
+	New        *VarBind
+	Generation uint64
+}
+
+type subscription struct {
+	prefix OID
+	ch     chan Change
+	mu     sync.Mutex
+	queue  []Change
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+// Subscribe returns a channel receiving the changes to the entries at and
+// below prefix, in commit order, computed as each generation is published.
+// Changes are queued so that a slow receiver does not block commits. The
+// channel is closed by Unsubscribe.
+func (c *Cache) Subscribe(prefix OID) <-chan Change {
+	s := &subscription{
+		prefix: prefix,
+		ch:     make(chan Change),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	c.subsMu.Lock()
+	c.subs = append(c.subs, s)
+	c.subsMu.Unlock()
+
+	go s.run()
+	return s.ch
+}
+
+// Unsubscribe stops the delivery of changes to ch and closes it, changes not
+// received yet are dropped
+func (c *Cache) Unsubscribe(ch <-chan Change) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for i, s := range c.subs {
+		if s.ch == ch {
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			close(s.done)
+			return
+		}
+	}
+}
+
+func (s *subscription) push(changes []Change) {
+	s.mu.Lock()
+	for _, ch := range changes {
+		if ch.OID.StartsWith(s.prefix) {
+			s.queue = append(s.queue, ch)
+		}
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) run() {
+	defer close(s.ch)
+
+	for {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, ch := range queue {
+			select {
+			case s.ch <- ch:
+			case <-s.done:
+				return
+			}
+		}
+
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sameValue returns true when a and b have the same type and value
+func sameValue(a, b *VarBind) bool {
+	return a.Value.TypeString() == b.Value.TypeString() && a.Value.String() == b.Value.String()
+}
+
+func newChange(o OID, old, cur *VarBind, generation uint64) (Change, bool) {
+	switch {
+	case old == nil && cur == nil:
+		return Change{}, false
+	case old == nil:
+		return Change{ChangeAdded, o, nil, cur, generation}, true
+	case cur == nil:
+		return Change{ChangeRemoved, o, old, nil, generation}, true
+	case !sameValue(old, cur):
+		return Change{ChangeModified, o, old, cur, generation}, true
+	}
+	return Change{}, false
+}
+
+// diff returns the changes from old to next, sorted by OID. When changed is
+// not nil only those OIDs are compared, otherwise both indexes are merged.
+func diff(old, next *Snapshot, changed []OID) []Change {
+	var changes []Change
+
+	if changed != nil {
+		for _, o := range changed {
+			k := o.String()
+			if ch, ok := newChange(o, old.entries[k], next.entries[k], next.generation); ok {
+				changes = append(changes, ch)
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].OID.Compare(changes[j].OID) < 0
+		})
+		return changes
+	}
+
+	i, j := 0, 0
+	for i < len(old.index) || j < len(next.index) {
+		var a, b *VarBind
+		switch {
+		case j == len(next.index):
+			a = old.index[i]
+		case i == len(old.index):
+			b = next.index[j]
+		default:
+			switch cmp := old.index[i].OID.Compare(next.index[j].OID); {
+			case cmp < 0:
+				a = old.index[i]
+			case cmp > 0:
+				b = next.index[j]
+			default:
+				a, b = old.index[i], next.index[j]
+			}
+		}
+
+		o := b
+		if a != nil {
+			o = a
+			i++
+		}
+		if b != nil {
+			j++
+		}
+
+		if ch, ok := newChange(o.OID, a, b, next.generation); ok {
+			changes = append(changes, ch)
+		}
+	}
+	return changes
+}
+
+// store publishes next and queues the changes from the current snapshot
+// for subscribers, the lock must be held. When changed is not nil only those
+// OIDs may differ.
+func (c *Cache) store(next *Snapshot, changed []OID) {
+	cur := c.Snapshot()
+	c.snapshot.Store(next)
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	if len(c.subs) == 0 {
+		return
+	}
+
+	changes := diff(cur, next, changed)
+	if len(changes) == 0 {
+		return
+	}
+	for _, s := range c.subs {
+		s.push(changes)
+	}
+}
@@ -0,0 +1,89 @@
+package passpersist
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCacheSubscribe(t *testing.T) {
+	c := NewCache()
+	sub := c.Subscribe(MustNewOID("1.3.6.1.4.1.8072.1"))
+	all := c.Subscribe(MustNewOID("1.3.6.1.4.1.8072"))
+
+	vb := func(o string, v string) *VarBind {
+		return &VarBind{
+			OID:       MustNewOID(o),
+			ValueType: "STRING",
+			Value:     typedValue{Value: &StringVal{Value: v}},
+		}
+	}
+
+	receive := func(ch <-chan Change, n int) []string {
+		var got []string
+		for i := 0; i < n; i++ {
+			select {
+			case c := <-ch:
+				got = append(got, fmt.Sprintf("%d %s %s", c.Generation, c.Kind, c.OID.String()))
+			case <-time.After(time.Second):
+				t.Fatalf("timed out after %v", got)
+			}
+		}
+		return got
+	}
+
+	expect := func(ch <-chan Change, want ...string) {
+		t.Helper()
+		got := receive(ch, len(want))
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	c.Set(vb("1.3.6.1.4.1.8072.1.1", "a"))
+	c.Set(vb("1.3.6.1.4.1.8072.1.2", "b"))
+	c.Set(vb("1.3.6.1.4.1.8072.2.1", "c"))
+	c.Commit()
+
+	// unchanged values are not reported
+	c.Set(vb("1.3.6.1.4.1.8072.1.2", "B"))
+	c.Set(vb("1.3.6.1.4.1.8072.1.3", "d"))
+	c.Set(vb("1.3.6.1.4.1.8072.2.1", "c"))
+	c.Commit()
+
+	c.Upsert(vb("1.3.6.1.4.1.8072.2.2", "e"))
+	c.Delete(MustNewOID("1.3.6.1.4.1.8072.1.3"))
+	c.Apply()
+
+	expect(sub,
+		"1 added 1.3.6.1.4.1.8072.1.1",
+		"1 added 1.3.6.1.4.1.8072.1.2",
+		"2 removed 1.3.6.1.4.1.8072.1.1",
+		"2 modified 1.3.6.1.4.1.8072.1.2",
+		"2 added 1.3.6.1.4.1.8072.1.3",
+		"3 removed 1.3.6.1.4.1.8072.1.3",
+	)
+	expect(all,
+		"1 added 1.3.6.1.4.1.8072.1.1",
+		"1 added 1.3.6.1.4.1.8072.1.2",
+		"1 added 1.3.6.1.4.1.8072.2.1",
+		"2 removed 1.3.6.1.4.1.8072.1.1",
+		"2 modified 1.3.6.1.4.1.8072.1.2",
+		"2 added 1.3.6.1.4.1.8072.1.3",
+		"3 removed 1.3.6.1.4.1.8072.1.3",
+		"3 added 1.3.6.1.4.1.8072.2.2",
+	)
+
+	c.Unsubscribe(sub)
+	c.Set(vb("1.3.6.1.4.1.8072.1.9", "f"))
+	c.Commit()
+
+	select {
+	case ch, ok := <-sub:
+		if ok {
+			t.Errorf("got %v after unsubscribing", ch)
+		}
+	case <-time.After(time.Second):
+		t.Error("channel not closed")
+	}
+}
@@ -0,0 +1,397 @@
+package passpersist
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ColumnType is the SMI type of a table column
+type ColumnType int
+
+const (
+	ColumnString ColumnType = iota + 1
+	ColumnOctetString
+	ColumnInt
+	ColumnCounter32
+	ColumnCounter64
+	ColumnGauge
+	ColumnTimeTicks // time.Duration, or unsigned hundredths of seconds
+	ColumnIP
+	ColumnIPV6
+	ColumnOID
+)
+
+// TruthValue values of boolean columns
+const (
+	truthTrue  = 1
+	truthFalse = 2
+)
+
+// IndexType is the encoding of an INDEX component, see Index
+type IndexType int
+
+const (
+	IndexInt IndexType = iota + 1
+	IndexOctetString
+	IndexImpliedOctetString
+	IndexFixedOctetString
+	IndexIPAddress
+	IndexInetAddress
+	IndexOID
+	IndexImpliedOID
+)
+
+// Column is a columnar object of a table, Name is the key of its value in
+// the rows. With a DisplayHint, ColumnString values are rendered from
+// integers or octets as described by RFC 2579, e.g. "1x:" for MAC addresses.
+type Column struct {
+	Number      int
+	Name        string
+	Type        ColumnType
+	DisplayHint string
+}
+
+// IndexComponent is an INDEX of a table, Name is the key of its value in
+// the rows. Size is the length of IndexFixedOctetString components.
+type IndexComponent struct {
+	Name string
+	Type IndexType
+	Size int
+}
+
+// Table lays out rows as a conceptual table: the value of each column is
+// added at entry.column.index, the encoded INDEX components of the row.
+type Table struct {
+	entry   []int
+	index   []IndexComponent
+	columns []Column
+}
+
+// NewTable returns a table of entry, relative to the base OID, e.g. the
+// OID of ifEntry
+func NewTable(entry []int, index []IndexComponent, columns ...Column) (*Table, error) {
+	if len(index) == 0 {
+		return nil, errors.New("table has no index")
+	}
+	for i, c := range index {
+		if c.Type < IndexInt || c.Type > IndexImpliedOID {
+			return nil, fmt.Errorf("index '%s' has an unknown type", c.Name)
+		}
+		if (c.Type == IndexImpliedOctetString || c.Type == IndexImpliedOID) && i != len(index)-1 {
+			return nil, fmt.Errorf("index '%s' is IMPLIED but not last", c.Name)
+		}
+		if c.Type == IndexFixedOctetString && c.Size <= 0 {
+			return nil, fmt.Errorf("index '%s' has no size", c.Name)
+		}
+	}
+
+	numbers := make(map[int]bool)
+	for _, c := range columns {
+		if c.Number <= 0 || numbers[c.Number] {
+			return nil, fmt.Errorf("column '%s' has an invalid or duplicate number %d", c.Name, c.Number)
+		}
+		if c.Type < ColumnString || c.Type > ColumnOID {
+			return nil, fmt.Errorf("column '%s' has an unknown type", c.Name)
+		}
+		numbers[c.Number] = true
+	}
+
+	return &Table{
+		entry:   append([]int{}, entry...),
+		index:   index,
+		columns: columns,
+	}, nil
+}
+
+// MustNewTable is like NewTable but panics on error
+func MustNewTable(entry []int, index []IndexComponent, columns ...Column) *Table {
+	t, err := NewTable(entry, index, columns...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// AddRow adds the cells of row to table t. The row is a map keyed by the
+// names of the index components and columns, or a struct whose fields are
+// matched to them by name regardless of case. Columns with no or a nil value
+// are left out of the row.
+func (p *PassPersist) AddRow(t *Table, row any) error {
+	values, err := rowValues(row)
+	if err != nil {
+		return err
+	}
+
+	var index [][]int
+	for _, c := range t.index {
+		v, ok := values[strings.ToLower(c.Name)]
+		if !ok {
+			return fmt.Errorf("row has no value for index '%s'", c.Name)
+		}
+		subs, err := encodeIndex(c, v)
+		if err != nil {
+			return fmt.Errorf("index '%s': %w", c.Name, err)
+		}
+		index = append(index, subs)
+	}
+	suffix := Index(index...)
+
+	for _, c := range t.columns {
+		v, ok := values[strings.ToLower(c.Name)]
+		if !ok {
+			continue
+		}
+		tv, err := columnValue(c, v)
+		if err != nil {
+			return fmt.Errorf("column '%s': %w", c.Name, err)
+		}
+		if err := p.AddEntry(Index(t.entry, []int{c.Number}, suffix), tv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MustAddRow is like AddRow but panics on error
+func (p *PassPersist) MustAddRow(t *Table, row any) {
+	err := p.AddRow(t, row)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// rowValues returns the values of a map or struct row keyed by lower case
+// name, nil pointers are left out
+func rowValues(row any) (map[string]any, error) {
+	v := reflect.ValueOf(row)
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	values := make(map[string]any)
+	add := func(name string, fv reflect.Value) {
+		for fv.Kind() == reflect.Pointer || fv.Kind() == reflect.Interface {
+			if fv.IsNil() {
+				return
+			}
+			fv = fv.Elem()
+		}
+		values[strings.ToLower(name)] = fv.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("row map keys must be strings, not %s", v.Type().Key())
+		}
+		for it := v.MapRange(); it.Next(); {
+			add(it.Key().String(), it.Value())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.IsExported() {
+				add(f.Name, v.Field(i))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("row must be a map or a struct, not %T", row)
+	}
+	return values, nil
+}
+
+func encodeIndex(c IndexComponent, v any) ([]int, error) {
+	switch c.Type {
+	case IndexInt:
+		i, err := toUint(v, 32)
+		if err != nil {
+			return nil, err
+		}
+		return IntIndex(uint32(i)), nil
+	case IndexOctetString, IndexImpliedOctetString, IndexFixedOctetString:
+		b, err := toBytes(v)
+		if err != nil {
+			return nil, err
+		}
+		switch c.Type {
+		case IndexImpliedOctetString:
+			return ImpliedOctetStringIndex(b), nil
+		case IndexFixedOctetString:
+			if len(b) != c.Size {
+				return nil, fmt.Errorf("%d octets, want %d", len(b), c.Size)
+			}
+			return FixedOctetStringIndex(b), nil
+		}
+		return OctetStringIndex(b), nil
+	case IndexIPAddress, IndexInetAddress:
+		a, err := toAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		if c.Type == IndexInetAddress {
+			return InetAddressIndex(a), nil
+		}
+		return IPAddressIndex(a)
+	case IndexOID, IndexImpliedOID:
+		o, ok := v.(OID)
+		if !ok {
+			return nil, fmt.Errorf("cannot use %T as an OID", v)
+		}
+		if c.Type == IndexImpliedOID {
+			return ImpliedOIDIndex(o), nil
+		}
+		return OIDIndex(o), nil
+	}
+	return nil, fmt.Errorf("unknown index type %d", c.Type)
+}
+
+// columnValue converts v to a value of the type of c
+func columnValue(c Column, v any) (typedValue, error) {
+	t := c.Type
+	switch t {
+	case ColumnString:
+		if c.DisplayHint != "" {
+			s, err := formatDisplayHint(c.DisplayHint, v)
+			if err != nil {
+				return typedValue{}, err
+			}
+			return typedValue{&StringVal{s}}, nil
+		}
+		switch x := v.(type) {
+		case string:
+			return typedValue{&StringVal{x}}, nil
+		case fmt.Stringer:
+			return typedValue{&StringVal{x.String()}}, nil
+		}
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+			return typedValue{&StringVal{rv.String()}}, nil
+		}
+	case ColumnOctetString:
+		b, err := toBytes(v)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&OctetStringVal{b}}, nil
+	case ColumnInt:
+		i, err := toInt(v)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&IntVal{int32(i)}}, nil
+	case ColumnCounter32, ColumnGauge:
+		i, err := toUint(v, 32)
+		if err != nil {
+			return typedValue{}, err
+		}
+		if t == ColumnGauge {
+			return typedValue{&GaugeVal{uint32(i)}}, nil
+		}
+		return typedValue{&Counter32Val{uint32(i)}}, nil
+	case ColumnCounter64:
+		i, err := toUint(v, 64)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&Counter64Val{i}}, nil
+	case ColumnTimeTicks:
+		if d, ok := v.(time.Duration); ok {
+			return typedValue{&TimeTicksVal{d}}, nil
+		}
+		// hundredths of seconds, as in the pass protocol
+		i, err := toUint(v, 32)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&TimeTicksVal{time.Duration(i) * 10 * time.Millisecond}}, nil
+	case ColumnIP, ColumnIPV6:
+		a, err := toAddr(v)
+		if err != nil {
+			return typedValue{}, err
+		}
+		if t == ColumnIPV6 {
+			return typedValue{&IPV6AddrVal{a}}, nil
+		}
+		if !a.Unmap().Is4() {
+			return typedValue{}, fmt.Errorf("not an IPv4 address: %s", a)
+		}
+		return typedValue{&IPAddrVal{a.Unmap()}}, nil
+	case ColumnOID:
+		if o, ok := v.(OID); ok {
+			return typedValue{&OIDVal{o}}, nil
+		}
+	default:
+		return typedValue{}, fmt.Errorf("unknown column type %d", t)
+	}
+	return typedValue{}, fmt.Errorf("cannot use %T as column type %d", v, t)
+}
+
+func toInt(v any) (int64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := rv.Int(); i >= -1<<31 && i < 1<<31 {
+			return i, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i := rv.Uint(); i < 1<<31 {
+			return int64(i), nil
+		}
+	case reflect.Bool:
+		// TruthValue
+		if rv.Bool() {
+			return truthTrue, nil
+		}
+		return truthFalse, nil
+	default:
+		return 0, fmt.Errorf("cannot use %T as an integer", v)
+	}
+	return 0, fmt.Errorf("%v overflows a 32 bit integer", v)
+}
+
+func toUint(v any, bits int) (uint64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := rv.Int(); i >= 0 && (bits == 64 || i < 1<<bits) {
+			return uint64(i), nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i := rv.Uint(); bits == 64 || i < 1<<bits {
+			return i, nil
+		}
+	default:
+		return 0, fmt.Errorf("cannot use %T as an unsigned integer", v)
+	}
+	return 0, fmt.Errorf("%v overflows an unsigned %d bit integer", v, bits)
+}
+
+func toBytes(v any) ([]byte, error) {
+	switch x := v.(type) {
+	case []byte:
+		return x, nil
+	case string:
+		return []byte(x), nil
+	case net.HardwareAddr:
+		return x, nil
+	}
+	return nil, fmt.Errorf("cannot use %T as an octet string", v)
+}
+
+func toAddr(v any) (netip.Addr, error) {
+	switch x := v.(type) {
+	case netip.Addr:
+		return x, nil
+	case net.IP:
+		if a, ok := netip.AddrFromSlice(x); ok {
+			return a, nil
+		}
+	case string:
+		return netip.ParseAddr(x)
+	}
+	return netip.Addr{}, fmt.Errorf("cannot use %T as an address", v)
+}
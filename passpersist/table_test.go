@@ -0,0 +1,87 @@
+package passpersist
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTable(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	table := MustNewTable([]int{2, 1},
+		[]IndexComponent{
+			{Name: "ifIndex", Type: IndexInt},
+			{Name: "name", Type: IndexImpliedOctetString},
+		},
+		Column{Number: 1, Name: "descr", Type: ColumnString},
+		Column{Number: 2, Name: "inOctets", Type: ColumnCounter64},
+		Column{Number: 3, Name: "addr", Type: ColumnIP},
+		Column{Number: 4, Name: "up", Type: ColumnInt},
+		Column{Number: 5, Name: "lastChange", Type: ColumnTimeTicks},
+	)
+
+	type iface struct {
+		IfIndex    int
+		Name       string
+		Descr      string
+		InOctets   uint64
+		Addr       *netip.Addr
+		Up         bool
+		LastChange time.Duration
+	}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+		pp.MustAddRow(table, iface{1, "lo", "loopback", 42, &addr, true, time.Second})
+		pp.MustAddRow(table, &iface{IfIndex: 2, Name: "e0", Descr: "ethernet"})
+		return pp.AddRow(table, map[string]any{"ifindex": 3, "name": "e1", "inoctets": uint32(7), "lastchange": uint(150)})
+	})
+
+	want := []string{
+		"1.3.6.1.4.1.8072.2.1.1.1.108.111=loopback",
+		"1.3.6.1.4.1.8072.2.1.1.2.101.48=ethernet",
+		"1.3.6.1.4.1.8072.2.1.2.1.108.111=42",
+		"1.3.6.1.4.1.8072.2.1.2.2.101.48=0",
+		"1.3.6.1.4.1.8072.2.1.2.3.101.49=7",
+		"1.3.6.1.4.1.8072.2.1.3.1.108.111=192.0.2.1",
+		"1.3.6.1.4.1.8072.2.1.4.1.108.111=1",
+		"1.3.6.1.4.1.8072.2.1.4.2.101.48=2",
+		"1.3.6.1.4.1.8072.2.1.5.1.108.111=1s",
+		"1.3.6.1.4.1.8072.2.1.5.2.101.48=0s",
+		"1.3.6.1.4.1.8072.2.1.5.3.101.49=1.5s",
+	}
+	var got []string
+	pp.Cache().Walk(OID{}, func(vb *VarBind) error {
+		got = append(got, vb.OID.String()+"="+vb.Value.String())
+		return nil
+	})
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	errors := []any{
+		map[string]any{"name": "x"},                            // missing index
+		map[string]any{"ifIndex": -1, "name": "x"},             // negative index
+		map[string]any{"ifIndex": 1, "name": 2},                // wrong index type
+		map[string]any{"ifIndex": 1, "name": "x", "up": "yes"}, // wrong column type
+		42,
+	}
+	for _, row := range errors {
+		if err := pp.AddRow(table, row); err == nil {
+			t.Errorf("%v: expected an error", row)
+		}
+	}
+
+	if _, err := NewTable([]int{3}, nil); err == nil {
+		t.Error("expected a table without index to be rejected")
+	}
+	if _, err := NewTable([]int{3}, []IndexComponent{{"a", IndexImpliedOID, 0}, {"b", IndexInt, 0}}); err == nil {
+		t.Error("expected an IMPLIED index which is not last to be rejected")
+	}
+	if _, err := NewTable([]int{3}, []IndexComponent{{"a", IndexInt, 0}}, Column{Number: 1, Name: "a", Type: ColumnInt}, Column{Number: 1, Name: "b", Type: ColumnInt}); err == nil {
+		t.Error("expected duplicate columns to be rejected")
+	}
+}
@@ -0,0 +1,163 @@
+package passpersist
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// TruthValue values of stale columns
+const (
+	staleTrue  = 1
+	staleFalse = 2
+)
+
+// TTL expires the entries at and below Subs which were not updated for
+// Duration, e.g. interfaces no longer reported by an incremental collector.
+// Expired entries are removed, unless StaleColumn is set: they are then kept
+// and flagged in that column, which holds a TruthValue for every entry at
+// StaleColumn followed by the entry's OID suffix below Subs.
+type TTL struct {
+	Subs        []int
+	Duration    time.Duration
+	StaleColumn []int
+}
+
+type ttl struct {
+	oid      OID
+	duration time.Duration
+	column   OID
+}
+
+// AddTTL adds an expiry policy. Entries expire at their deadline, stale
+// columns of new entries are added within half of the shortest TTL.
+func (p *PassPersist) AddTTL(t TTL) error {
+	if t.Duration <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	oid, err := p.baseOID.Append(t.Subs)
+	if err != nil {
+		return err
+	}
+
+	var column OID
+	if t.StaleColumn != nil {
+		if column, err = p.baseOID.Append(t.StaleColumn); err != nil {
+			return err
+		}
+	}
+
+	p.ttls = append(p.ttls, &ttl{oid, t.Duration, column})
+	return nil
+}
+
+func (p *PassPersist) MustAddTTL(t TTL) {
+	err := p.AddTTL(t)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// flagsIn returns true when a stale column overlaps the subtree at prefix
+func (p *PassPersist) flagsIn(prefix OID, exclude []OID) bool {
+	for _, t := range p.ttls {
+		if len(t.column.Value) > 0 && (inSubtree(t.column, prefix, exclude) || prefix.StartsWith(t.column)) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireLoop expires entries until ctx is done
+func (p *PassPersist) expireLoop(ctx context.Context) {
+	timer := time.NewTimer(time.Until(p.expire(time.Now())))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			timer.Reset(time.Until(p.expire(now)))
+		}
+	}
+}
+
+// expire removes or flags the entries not updated within their TTL as of
+// now and returns when it should run next: at the following deadline, or
+// within half of the shortest TTL to flag new entries
+func (p *PassPersist) expire(now time.Time) time.Time {
+	c := p.cache
+
+	wake := now.Add(p.ttls[0].duration / 2)
+	for _, t := range p.ttls[1:] {
+		if n := now.Add(t.duration / 2); n.Before(wake) {
+			wake = n
+		}
+	}
+
+	c.Lock()
+	snap := c.Snapshot()
+
+	var ops []cacheOp
+	for _, t := range p.ttls {
+		hasColumn := len(t.column.Value) > 0
+		flags := make(map[string]bool)
+
+		for i := snap.searchIndex(t.oid); i < len(snap.index) && snap.index[i].OID.StartsWith(t.oid); i++ {
+			vb := snap.index[i]
+			if hasColumn && vb.OID.StartsWith(t.column) {
+				continue
+			}
+
+			deadline := vb.updated.Add(t.duration)
+			stale := !now.Before(deadline)
+			if !stale && deadline.Before(wake) {
+				wake = deadline
+			}
+			if !hasColumn {
+				if stale {
+					ops = append(ops, cacheOp{oid: vb.OID})
+				}
+				continue
+			}
+
+			flag := OID{append(append([]int{}, t.column.Value...), vb.OID.Value[len(t.oid.Value):]...)}
+			flags[flag.String()] = true
+
+			want := int32(staleFalse)
+			if stale {
+				want = staleTrue
+			}
+			if cur := snap.Get(flag); cur != nil && cur.Value.GetIntVal() == want {
+				continue
+			}
+
+			v := typedValue{&IntVal{want}}
+			ops = append(ops, cacheOp{oid: flag, vb: &VarBind{
+				OID:       flag,
+				ValueType: v.TypeString(),
+				Value:     v,
+				updated:   now,
+			}})
+		}
+
+		// flags of entries which no longer exist
+		if hasColumn {
+			for i := snap.searchIndex(t.column); i < len(snap.index) && snap.index[i].OID.StartsWith(t.column); i++ {
+				if o := snap.index[i].OID; !flags[o.String()] {
+					ops = append(ops, cacheOp{oid: o})
+				}
+			}
+		}
+	}
+
+	c.applyOps(ops, nil)
+	next := c.Snapshot()
+	c.Unlock()
+
+	written, deleted := splitOps(ops)
+	p.evaluateRules(committed(next, written), removed(snap, next, deleted))
+	return wake
+}
@@ -0,0 +1,121 @@
+package passpersist
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	base := MustNewOID("1.3.6.1.4.1.8072")
+	pp := NewPassPersist(WithBaseOID(base), WithIncremental())
+
+	pp.MustAddTTL(TTL{Subs: []int{2}, Duration: time.Minute})
+	pp.MustAddTTL(TTL{Subs: []int{3, 1}, Duration: time.Minute, StaleColumn: []int{3, 9}})
+	if err := pp.AddTTL(TTL{Subs: []int{4}}); err == nil {
+		t.Error("expected a zero ttl to be rejected")
+	}
+
+	var cleared []string
+	pp.MustAddRule(Rule{
+		Subs:      []int{2},
+		Condition: func(_, _ *VarBind) bool { return true },
+		Action: func(e Event) {
+			if !e.Raised {
+				cleared = append(cleared, e.OID.String())
+			}
+		},
+	})
+
+	update := func(subs ...[]int) {
+		refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+			for _, s := range subs {
+				pp.MustAddString(s, "up")
+			}
+			return nil
+		})
+	}
+
+	update([]int{1}, []int{2, 1}, []int{2, 2}, []int{3, 1, 1}, []int{3, 1, 2})
+	pp.expire(time.Now())
+
+	flags := map[string]int32{
+		"1.3.6.1.4.1.8072.3.9.1": staleFalse,
+		"1.3.6.1.4.1.8072.3.9.2": staleFalse,
+	}
+	for o, want := range flags {
+		if v := pp.get(MustNewOID(o)); v == nil || v.Value.GetIntVal() != want {
+			t.Errorf("%s: got %v, want %d", o, v, want)
+		}
+	}
+
+	// age the committed entries, then only report 2.1 and 3.1.1 again
+	for _, vb := range pp.Cache().Snapshot().index {
+		vb.updated = vb.updated.Add(-2 * time.Minute)
+	}
+	update([]int{2, 1}, []int{3, 1, 1})
+	pp.expire(time.Now())
+
+	if len(cleared) != 1 || cleared[0] != "1.3.6.1.4.1.8072.2.2" {
+		t.Errorf("expected the alarm of the expired entry to be cleared, got %v", cleared)
+	}
+
+	tests := map[string]string{
+		"1.3.6.1.4.1.8072.1":     "up",
+		"1.3.6.1.4.1.8072.2.1":   "up",
+		"1.3.6.1.4.1.8072.2.2":   "",
+		"1.3.6.1.4.1.8072.3.1.1": "up",
+		"1.3.6.1.4.1.8072.3.1.2": "up",
+		"1.3.6.1.4.1.8072.3.9.1": "2",
+		"1.3.6.1.4.1.8072.3.9.2": "1",
+	}
+	for o, want := range tests {
+		got := ""
+		if v := pp.get(MustNewOID(o)); v != nil {
+			got = v.Value.String()
+		}
+		if got != want {
+			t.Errorf("%s: got '%s', want '%s'", o, got, want)
+		}
+	}
+}
+
+func TestTTLDeadline(t *testing.T) {
+	base := MustNewOID("1.3.6.1.4.1.8072")
+	pp := NewPassPersist(WithBaseOID(base), WithIncremental())
+	pp.MustAddTTL(TTL{Subs: []int{2}, Duration: time.Minute})
+
+	refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+		return pp.AddString([]int{2, 1}, "up")
+	})
+	updated := pp.get(base.MustAppend([]int{2, 1})).updated
+
+	// the next run is at the deadline rather than half a TTL later
+	if next := pp.expire(updated.Add(50 * time.Second)); !next.Equal(updated.Add(time.Minute)) {
+		t.Errorf("next expiry at %s, want the deadline %s", next, updated.Add(time.Minute))
+	}
+	if pp.get(base.MustAppend([]int{2, 1})) == nil {
+		t.Fatal("entry expired before its deadline")
+	}
+
+	pp.expire(updated.Add(time.Minute))
+	if pp.get(base.MustAppend([]int{2, 1})) != nil {
+		t.Error("entry not expired at its deadline")
+	}
+}
+
+func TestTTLReplace(t *testing.T) {
+	base := MustNewOID("1.3.6.1.4.1.8072")
+	pp := NewPassPersist(WithBaseOID(base))
+	pp.MustAddTTL(TTL{Subs: []int{3, 1}, Duration: time.Minute, StaleColumn: []int{3, 9}})
+
+	// each full refresh replaces the subtree, flags are recomputed at commit
+	for i := 0; i < 2; i++ {
+		refreshBase(context.Background(), pp, func(_ context.Context, pp *PassPersist) error {
+			return pp.AddString([]int{3, 1, 1}, "up")
+		})
+		if v := pp.get(base.MustAppend([]int{3, 9, 1})); v == nil || v.Value.GetIntVal() != staleFalse {
+			t.Errorf("refresh %d: got stale flag %v, want %d", i, v, staleFalse)
+		}
+	}
+}
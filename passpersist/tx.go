@@ -0,0 +1,291 @@
+package passpersist
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var errTxDone = errors.New("transaction already committed or aborted")
+
+// Tx stages entries isolated from other writers until Commit publishes them
+// atomically, or Abort drops them. Its Add, Delete and DeleteSubtree methods
+// are those of PassPersist with subs relative to its subtree, they fail once
+// the transaction is done.
+type Tx struct {
+	// view stages the entries of the transaction
+	view    *PassPersist
+	parent  *PassPersist
+	prefix  OID
+	exclude []OID
+	// replace commits the staged entries in place of all the entries of the
+	// subtree rather than on top of them
+	replace bool
+	// merge also commits the entries staged on the parent outside of
+	// transactions, e.g. through the handle passed to Run
+	merge bool
+
+	mu   sync.Mutex
+	done bool
+}
+
+// Begin starts a transaction of upserts and deletions below the base OID,
+// e.g. to update entries from another goroutine than the collectors.
+// Entries which are not staged are kept on Commit.
+func (p *PassPersist) Begin() *Tx {
+	v := p.view(p.baseOID)
+	v.incremental = true
+
+	tx := &Tx{
+		view:   v,
+		parent: p,
+		prefix: p.baseOID,
+	}
+	v.tx = tx
+	return tx
+}
+
+// begin starts the transaction of a refresh of c, which replaces the
+// entries of its subtree unless in incremental mode. The transaction of the
+// base OID collector also commits the entries added to p itself.
+func (p *PassPersist) begin(c *collector) *Tx {
+	v := p.view(c.oid)
+
+	tx := &Tx{
+		view:    v,
+		parent:  p,
+		prefix:  c.oid,
+		exclude: c.exclude,
+		replace: !p.incremental,
+		merge:   c.oid.Equal(p.baseOID),
+	}
+	v.tx = tx
+	return tx
+}
+
+// Commit publishes the staged entries and changes as a single generation
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+
+	c := tx.parent.cache
+	var written []*VarBind
+	var deleted []OID
+	var prev, next *Snapshot
+	if tx.replace {
+		staged := tx.view.cache.takeStaged()
+		if tx.merge {
+			for k, vb := range c.takeStaged() {
+				if _, ok := staged[k]; !ok {
+					staged[k] = vb
+				}
+			}
+		}
+		for _, vb := range staged {
+			written = append(written, vb)
+		}
+		deleted = []OID{tx.prefix}
+
+		c.Lock()
+		prev = c.Snapshot()
+		c.commitSubtree(staged, tx.prefix, tx.exclude)
+		next = c.Snapshot()
+		c.Unlock()
+	} else {
+		ops := tx.view.cache.takeOps()
+		if tx.merge {
+			ops = append(c.takeOps(), ops...)
+		}
+		written, deleted = splitOps(ops)
+
+		c.Lock()
+		prev = c.Snapshot()
+		c.applyOps(ops, func(o OID) bool {
+			return inSubtree(o, tx.prefix, tx.exclude)
+		})
+		next = c.Snapshot()
+		c.Unlock()
+	}
+
+	tx.parent.savePersisted()
+	tx.parent.evaluateRules(committed(next, written), removed(prev, next, deleted))
+
+	// replacing the subtree dropped the stale flags within it
+	if tx.replace && tx.parent.flagsIn(tx.prefix, tx.exclude) {
+		tx.parent.expire(time.Now())
+	}
+	return nil
+}
+
+// Abort drops the staged entries and changes
+func (tx *Tx) Abort() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+
+	tx.view.cache.Discard()
+	if tx.merge {
+		tx.parent.cache.Discard()
+	}
+	return nil
+}
+
+// stage calls fn with the view unless the transaction is done
+func (tx *Tx) stage(fn func(v *PassPersist) error) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return errTxDone
+	}
+	return fn(tx.view)
+}
+
+func (tx *Tx) AddEntry(subs []int, value typedValue) error {
+	return tx.stage(func(v *PassPersist) error { return v.AddEntry(subs, value) })
+}
+
+// Delete removes the entry at subs on Commit, in incremental mode
+func (tx *Tx) Delete(subs []int) error {
+	return tx.stage(func(v *PassPersist) error { return v.Delete(subs) })
+}
+
+// DeleteSubtree removes the entries at and below subs on Commit, in
+// incremental mode
+func (tx *Tx) DeleteSubtree(subs []int) error {
+	return tx.stage(func(v *PassPersist) error { return v.DeleteSubtree(subs) })
+}
+
+func (tx *Tx) AddString(subIds []int, value string) error {
+	return tx.AddEntry(subIds, typedValue{&StringVal{value}})
+}
+func (tx *Tx) MustAddString(subIds []int, value string) {
+	err := tx.AddString(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddInt(subIds []int, value int32) error {
+	return tx.AddEntry(subIds, typedValue{&IntVal{value}})
+}
+func (tx *Tx) MustAddInt(subIds []int, value int32) {
+	err := tx.AddInt(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddOID(subIds []int, value OID) error {
+	return tx.AddEntry(subIds, typedValue{&OIDVal{value}})
+}
+func (tx *Tx) MustAddOID(subIds []int, value OID) {
+	err := tx.AddOID(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddOctetString(subIds []int, value []byte) error {
+	return tx.AddEntry(subIds, typedValue{&OctetStringVal{value}})
+}
+func (tx *Tx) MustAddOctetString(subIds []int, value []byte) {
+	err := tx.AddOctetString(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddIP(subIds []int, value netip.Addr) error {
+	return tx.AddEntry(subIds, typedValue{&IPAddrVal{value}})
+}
+func (tx *Tx) MustAddIP(subIds []int, value netip.Addr) {
+	err := tx.AddIP(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddIPV6(subIds []int, value netip.Addr) error {
+	return tx.AddEntry(subIds, typedValue{&IPV6AddrVal{value}})
+}
+func (tx *Tx) MustAddIPV6(subIds []int, value netip.Addr) {
+	err := tx.AddIPV6(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddCounter32(subIds []int, value uint32) error {
+	return tx.AddEntry(subIds, typedValue{&Counter32Val{value}})
+}
+func (tx *Tx) MustAddCounter32(subIds []int, value uint32) {
+	err := tx.AddCounter32(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddCounter64(subIds []int, value uint64) error {
+	return tx.AddEntry(subIds, typedValue{&Counter64Val{value}})
+}
+func (tx *Tx) MustAddCounter64(subIds []int, value uint64) {
+	err := tx.AddCounter64(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddGauge(subIds []int, value uint32) error {
+	return tx.AddEntry(subIds, typedValue{&GaugeVal{value}})
+}
+func (tx *Tx) MustAddGauge(subIds []int, value uint32) {
+	err := tx.AddGauge(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+func (tx *Tx) AddTimeTicks(subIds []int, value time.Duration) error {
+	return tx.AddEntry(subIds, typedValue{&TimeTicksVal{value}})
+}
+func (tx *Tx) MustAddTimeTicks(subIds []int, value time.Duration) {
+	err := tx.AddTimeTicks(subIds, value)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// AddRow adds the cells of row to table t, see PassPersist.AddRow
+func (tx *Tx) AddRow(t *Table, row any) error {
+	return tx.stage(func(v *PassPersist) error { return v.AddRow(t, row) })
+}
+func (tx *Tx) MustAddRow(t *Table, row any) {
+	err := tx.AddRow(t, row)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// AddStruct adds the tagged fields of v below subs, see
+// PassPersist.AddStruct
+func (tx *Tx) AddStruct(subs []int, v any) error {
+	return tx.stage(func(view *PassPersist) error { return view.AddStruct(subs, v) })
+}
+func (tx *Tx) MustAddStruct(subs []int, v any) {
+	err := tx.AddStruct(subs, v)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RunTx is like RunContext but f receives the transaction of each update.
+// It is committed when f returns nil, unless f committed or aborted it, and
+// aborted otherwise.
+func (p *PassPersist) RunTx(ctx context.Context, f func(context.Context, *Tx) error) {
+	p.RunContext(ctx, func(ctx context.Context, v *PassPersist) error {
+		return f(ctx, v.tx)
+	})
+}
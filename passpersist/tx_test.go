@@ -0,0 +1,57 @@
+package passpersist
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTx(t *testing.T) {
+	pp := NewPassPersist(WithBaseOID(MustNewOID("1.3.6.1.4.1.8072")))
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx := pp.Begin()
+			for j := 1; j <= 100; j++ {
+				tx.MustAddInt([]int{i, j}, int32(j))
+			}
+			if err := tx.Commit(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := pp.Cache().Snapshot().Len(); n != 800 {
+		t.Errorf("got %d entries, want 800", n)
+	}
+
+	tx := pp.Begin()
+	tx.MustAddString([]int{9}, "aborted")
+	if err := tx.DeleteSubtree([]int{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Abort(); err != nil {
+		t.Error(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Error("expected commit after abort to fail")
+	}
+	if err := tx.AddString([]int{9}, "late"); err == nil {
+		t.Error("expected add after abort to fail")
+	}
+	if pp.get(MustNewOID("1.3.6.1.4.1.8072.9")) != nil || pp.Cache().Snapshot().Len() != 800 {
+		t.Error("aborted transaction was committed")
+	}
+
+	tx = pp.Begin()
+	if err := tx.DeleteSubtree([]int{1}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	if n := pp.Cache().Snapshot().Len(); n != 700 {
+		t.Errorf("got %d entries, want 700", n)
+	}
+}
@@ -0,0 +1,267 @@
+package passpersist
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+)
+
+// AuthProtocol is a USM authentication protocol
+type AuthProtocol int
+
+const (
+	AuthSHA AuthProtocol = iota + 1
+	AuthSHA224
+	AuthSHA256
+	AuthSHA384
+	AuthSHA512
+)
+
+func (a AuthProtocol) String() string {
+	switch a {
+	case AuthSHA:
+		return "SHA"
+	case AuthSHA224:
+		return "SHA-224"
+	case AuthSHA256:
+		return "SHA-256"
+	case AuthSHA384:
+		return "SHA-384"
+	case AuthSHA512:
+		return "SHA-512"
+	}
+	return "unknown"
+}
+
+func (a AuthProtocol) hash() func() hash.Hash {
+	switch a {
+	case AuthSHA:
+		return sha1.New
+	case AuthSHA224:
+		return sha256.New224
+	case AuthSHA256:
+		return sha256.New
+	case AuthSHA384:
+		return sha512.New384
+	case AuthSHA512:
+		return sha512.New
+	}
+	return nil
+}
+
+// macLen returns the length of the truncated HMAC, RFC 3414 and RFC 7860
+func (a AuthProtocol) macLen() int {
+	switch a {
+	case AuthSHA:
+		return 12
+	case AuthSHA224:
+		return 16
+	case AuthSHA256:
+		return 24
+	case AuthSHA384:
+		return 32
+	case AuthSHA512:
+		return 48
+	}
+	return 0
+}
+
+// PrivProtocol is a USM privacy protocol
+type PrivProtocol int
+
+const (
+	PrivNone PrivProtocol = iota
+	PrivAES
+	PrivAES192
+	PrivAES256
+)
+
+func (p PrivProtocol) String() string {
+	switch p {
+	case PrivNone:
+		return "none"
+	case PrivAES:
+		return "AES"
+	case PrivAES192:
+		return "AES-192"
+	case PrivAES256:
+		return "AES-256"
+	}
+	return "unknown"
+}
+
+func (p PrivProtocol) keyLen() int {
+	switch p {
+	case PrivAES:
+		return 16
+	case PrivAES192:
+		return 24
+	case PrivAES256:
+		return 32
+	}
+	return 0
+}
+
+// usmUser is a user with keys localized to the agent's engine ID
+type usmUser struct {
+	name    string
+	auth    AuthProtocol
+	priv    PrivProtocol
+	authKey []byte
+	privKey []byte
+}
+
+func newUSMUser(name string, auth AuthProtocol, authPassword string, priv PrivProtocol, privPassword string, engineID []byte) (*usmUser, error) {
+	h := auth.hash()
+	if h == nil {
+		return nil, fmt.Errorf("user '%s': unsupported authentication protocol", name)
+	}
+	if len(authPassword) < 8 {
+		return nil, fmt.Errorf("user '%s': authentication password must be at least 8 characters", name)
+	}
+
+	u := &usmUser{
+		name:    name,
+		auth:    auth,
+		priv:    priv,
+		authKey: localizeKey(h, passwordToKey(h, []byte(authPassword)), engineID),
+	}
+
+	if priv != PrivNone {
+		n := priv.keyLen()
+		if n == 0 {
+			return nil, fmt.Errorf("user '%s': unsupported privacy protocol", name)
+		}
+		if len(privPassword) < 8 {
+			return nil, fmt.Errorf("user '%s': privacy password must be at least 8 characters", name)
+		}
+		key := localizeKey(h, passwordToKey(h, []byte(privPassword)), engineID)
+		u.privKey = extendKey(h, key, n)[:n]
+	}
+
+	return u, nil
+}
+
+// passwordToKey implements the password to key algorithm of RFC 3414 A.2
+func passwordToKey(h func() hash.Hash, password []byte) []byte {
+	d := h()
+	buf := make([]byte, 64)
+	pos := 0
+	for n := 0; n < 1048576; n += len(buf) {
+		for i := range buf {
+			buf[i] = password[pos%len(password)]
+			pos++
+		}
+		d.Write(buf)
+	}
+	return d.Sum(nil)
+}
+
+// localizeKey derives the key used with a specific engine, RFC 3414 2.6
+func localizeKey(h func() hash.Hash, key []byte, engineID []byte) []byte {
+	d := h()
+	d.Write(key)
+	d.Write(engineID)
+	d.Write(key)
+	return d.Sum(nil)
+}
+
+// extendKey extends a localized key to n octets by appending the hash of the
+// key so far, as net-snmp does for AES-192 and AES-256 (Blumenthal)
+func extendKey(h func() hash.Hash, key []byte, n int) []byte {
+	for len(key) < n {
+		d := h()
+		d.Write(key)
+		key = append(key, d.Sum(nil)...)
+	}
+	return key
+}
+
+func (u *usmUser) mac(msg []byte) []byte {
+	m := hmac.New(u.auth.hash(), u.authKey)
+	m.Write(msg)
+	return m.Sum(nil)[:u.auth.macLen()]
+}
+
+// authenticate writes the MAC of msg to its authentication parameters at
+// offset, which must be zeroed
+func (u *usmUser) authenticate(msg []byte, offset int) {
+	copy(msg[offset:], u.mac(msg))
+}
+
+// verify checks the MAC at offset of msg
+func (u *usmUser) verify(msg []byte, offset int) bool {
+	n := u.auth.macLen()
+	if offset < 0 || offset+n > len(msg) {
+		return false
+	}
+
+	received := make([]byte, n)
+	copy(received, msg[offset:offset+n])
+
+	zeroed := make([]byte, len(msg))
+	copy(zeroed, msg)
+	for i := offset; i < offset+n; i++ {
+		zeroed[i] = 0
+	}
+
+	return hmac.Equal(received, u.mac(zeroed))
+}
+
+// aesIV returns the AES initialization vector of RFC 3826 3.1.2.1
+func aesIV(boots int32, time int32, salt []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv[0:], uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(time))
+	copy(iv[8:], salt)
+	return iv
+}
+
+func (u *usmUser) encrypt(plain []byte, boots int32, time int32, salt []byte) ([]byte, error) {
+	return aesCFB(u.privKey, aesIV(boots, time, salt), plain, false)
+}
+
+func (u *usmUser) decrypt(data []byte, boots int32, time int32, salt []byte) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("invalid privacy parameters length %d", len(salt))
+	}
+	return aesCFB(u.privKey, aesIV(boots, time, salt), data, true)
+}
+
+// aesCFB encrypts or decrypts data with AES in 128 bit cipher feedback mode
+func aesCFB(key []byte, iv []byte, data []byte, decrypt bool) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(data))
+	feedback := make([]byte, aes.BlockSize)
+	copy(feedback, iv)
+	stream := make([]byte, aes.BlockSize)
+
+	for i := 0; i < len(data); i += aes.BlockSize {
+		block.Encrypt(stream, feedback)
+
+		end := i + aes.BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		for j := i; j < end; j++ {
+			out[j] = data[j] ^ stream[j-i]
+		}
+
+		if decrypt {
+			copy(feedback, data[i:end])
+		} else {
+			copy(feedback, out[i:end])
+		}
+	}
+
+	return out, nil
+}
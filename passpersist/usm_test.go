@@ -0,0 +1,104 @@
+package passpersist
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestLocalizeKey(t *testing.T) {
+	// RFC 3414 A.3.2
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	h := AuthSHA.hash()
+
+	ku := passwordToKey(h, []byte("maplesyrup"))
+	if got := hex.EncodeToString(ku); got != "9fb5cc0381497b3793528939ff788d5d79145211" {
+		t.Errorf("unexpected key %s", got)
+	}
+
+	kul := localizeKey(h, ku, engineID)
+	if got := hex.EncodeToString(kul); got != "6695febc9288e36282235fc7151f128497b38f3f" {
+		t.Errorf("unexpected localized key %s", got)
+	}
+}
+
+func TestExtendKey(t *testing.T) {
+	// the localized key of RFC 3414 A.3.2 extended with SHA-1 as in
+	// draft-blumenthal-aes-usm-04 3.1.2.1, Kul || SHA-1(Kul)
+	kul, _ := hex.DecodeString("6695febc9288e36282235fc7151f128497b38f3f")
+
+	for _, tt := range []struct {
+		priv PrivProtocol
+		want string
+	}{
+		{PrivAES192, "6695febc9288e36282235fc7151f128497b38f3f505e07eb"},
+		{PrivAES256, "6695febc9288e36282235fc7151f128497b38f3f505e07eb9af25568fa1f5dbe"},
+	} {
+		n := tt.priv.keyLen()
+		if got := hex.EncodeToString(extendKey(AuthSHA.hash(), append([]byte{}, kul...), n)[:n]); got != tt.want {
+			t.Errorf("%s: unexpected key %s", tt.priv, got)
+		}
+	}
+
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	u, err := newUSMUser("user", AuthSHA, "maplesyrup", PrivAES256, "maplesyrup", engineID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(u.privKey); got != "6695febc9288e36282235fc7151f128497b38f3f505e07eb9af25568fa1f5dbe" {
+		t.Errorf("unexpected AES-256 key %s", got)
+	}
+}
+
+func TestUSMUserKeys(t *testing.T) {
+	engineID := newEngineID()
+
+	for _, priv := range []PrivProtocol{PrivAES, PrivAES192, PrivAES256} {
+		u, err := newUSMUser("user", AuthSHA, "authpassword", priv, "privpassword", engineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(u.privKey) != priv.keyLen() {
+			t.Errorf("%s: expected key length %d, got %d", priv, priv.keyLen(), len(u.privKey))
+		}
+
+		plain := []byte("a scoped pdu which is not a multiple of the block size")
+		salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+		enc, err := u.encrypt(plain, 1, 100, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := u.decrypt(enc, 1, 100, salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec, plain) {
+			t.Errorf("%s: decrypted data does not match", priv)
+		}
+	}
+
+	if _, err := newUSMUser("user", AuthSHA, "short", PrivNone, "", engineID); err == nil {
+		t.Errorf("expected short password to be rejected")
+	}
+}
+
+func TestUSMAuthenticate(t *testing.T) {
+	for _, auth := range []AuthProtocol{AuthSHA, AuthSHA224, AuthSHA256, AuthSHA384, AuthSHA512} {
+		u, err := newUSMUser("user", auth, "authpassword", PrivNone, "", newEngineID())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := make([]byte, 100)
+		u.authenticate(msg, 10)
+		if !u.verify(msg, 10) {
+			t.Errorf("%s: failed to verify message", auth)
+		}
+
+		msg[0] = 1
+		if u.verify(msg, 10) {
+			t.Errorf("%s: verified modified message", auth)
+		}
+	}
+}
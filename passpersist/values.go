@@ -2,11 +2,13 @@ package passpersist
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/netip"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,6 +16,17 @@ type VarBind struct {
 	OID       OID        `json:"oid"`
 	ValueType string     `json:"type"`
 	Value     typedValue `json:"value"`
+
+	// updated is when the entry was staged, for TTLs
+	updated time.Time
+	// stale is set on entries loaded from a file
+	stale bool
+}
+
+// Stale returns true when the entry was loaded from a file and not updated
+// since
+func (r *VarBind) Stale() bool {
+	return r.stale
 }
 
 func (r *VarBind) String() string {
@@ -25,6 +38,100 @@ func (r *VarBind) Marshal() string {
 	return fmt.Sprintf("%s\n%s\n%s", r.OID, r.Value.TypeString(), r.Value.String())
 }
 
+// parseTypedValue parses a "TYPE VALUE" line as sent by snmpd with a set
+// request, e.g. 'integer 1' or 'string "hello"'.
+func parseTypedValue(line string) (typedValue, error) {
+	t, v, _ := strings.Cut(strings.TrimSpace(line), " ")
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && strings.HasPrefix(v, "\"") && strings.HasSuffix(v, "\"") {
+		v = v[1 : len(v)-1]
+	}
+
+	tv, err := parseValue(strings.ToLower(t), v)
+	if err != nil {
+		var se SetError
+		if errors.As(err, &se) {
+			return tv, err
+		}
+		return tv, fmt.Errorf("%w: %s", WrongValue, err)
+	}
+	return tv, nil
+}
+
+func parseValue(t string, v string) (typedValue, error) {
+	switch t {
+	case "string":
+		return typedValue{&StringVal{v}}, nil
+	case "octet":
+		b, err := parseHexString(v)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&OctetStringVal{b}}, nil
+	case "integer":
+		i, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&IntVal{int32(i)}}, nil
+	case "counter", "counter32":
+		i, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&Counter32Val{uint32(i)}}, nil
+	case "counter64":
+		i, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&Counter64Val{i}}, nil
+	case "gauge", "unsigned":
+		i, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&GaugeVal{uint32(i)}}, nil
+	case "timeticks":
+		i, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&TimeTicksVal{time.Duration(i) * 10 * time.Millisecond}}, nil
+	case "ipaddress":
+		a, err := netip.ParseAddr(v)
+		if err != nil {
+			return typedValue{}, err
+		}
+		if !a.Is4() {
+			return typedValue{}, fmt.Errorf("not an IPv4 address: %s", v)
+		}
+		return typedValue{&IPAddrVal{a}}, nil
+	case "objectid":
+		o, err := NewOID(v)
+		if err != nil {
+			return typedValue{}, err
+		}
+		return typedValue{&OIDVal{o}}, nil
+	}
+
+	return typedValue{}, fmt.Errorf("%w: unknown value type: %s", WrongType, t)
+}
+
+// parseHexString parses space separated hex bytes, e.g. "01 02 ff"
+func parseHexString(s string) ([]byte, error) {
+	fields := strings.Fields(s)
+	b := make([]byte, 0, len(fields))
+	for _, f := range fields {
+		i, err := strconv.ParseUint(f, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex byte '%s'", f)
+		}
+		b = append(b, byte(i))
+	}
+	return b, nil
+}
+
 type typedValue struct {
 	Value isTypedValue
 }
@@ -91,6 +198,58 @@ func (v *typedValue) TypeString() string {
 	return ""
 }
 
+// intValue returns the value of numeric types
+func (v *typedValue) intValue() (int64, bool) {
+	switch x := v.GetValue().(type) {
+	case *IntVal:
+		return int64(x.Value), true
+	case *Counter32Val:
+		return int64(x.Value), true
+	case *Counter64Val:
+		return int64(x.Value), true
+	case *GaugeVal:
+		return int64(x.Value), true
+	case *TimeTicksVal:
+		return int64(x.Value / (10 * time.Millisecond)), true
+	}
+	return 0, false
+}
+
+// compareInt compares numeric types with i and returns -1, 0 or +1, comparing
+// Counter64 values as unsigned so that they never wrap negative
+func (v *typedValue) compareInt(i int64) (int, bool) {
+	if x, ok := v.GetValue().(*Counter64Val); ok {
+		switch {
+		case i < 0 || x.Value > uint64(i):
+			return 1, true
+		case x.Value < uint64(i):
+			return -1, true
+		}
+		return 0, true
+	}
+	n, ok := v.intValue()
+	switch {
+	case !ok:
+		return 0, false
+	case n > i:
+		return 1, true
+	case n < i:
+		return -1, true
+	}
+	return 0, true
+}
+
+// size returns the length in octets of string types
+func (v *typedValue) size() (int, bool) {
+	switch x := v.GetValue().(type) {
+	case *StringVal:
+		return len(x.Value), true
+	case *OctetStringVal:
+		return len(x.Value), true
+	}
+	return 0, false
+}
+
 func (v *typedValue) GetValue() interface{} {
 	if v != nil {
 		return v.Value